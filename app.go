@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 
-	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cache"
 
@@ -14,15 +13,17 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/requestid"
 
 	// raccount "chatbox/app/route/account"
-	// rfile "chatbox/app/route/file"
 	// rstatic "chatbox/app/route/static"
 	rchannel "chatbox/app/route/channel"
 	rdm "chatbox/app/route/dm"
+	rfile "chatbox/app/route/file"
 	rmessage "chatbox/app/route/message"
+	rsearch "chatbox/app/route/search"
+	rstream "chatbox/app/route/stream"
 	ruser "chatbox/app/route/user"
+	rws "chatbox/app/route/ws"
 
-	"chatbox/pkg/channel"
-	hjwt "chatbox/pkg/handler/jwt"
+	hbody "chatbox/pkg/handler/body"
 	hskip "chatbox/pkg/handler/skip"
 	"chatbox/pkg/settings"
 )
@@ -42,6 +43,9 @@ func New() *fiber.App {
 	// Skip if proxy not trusted
 	app.Use(hskip.ProxyTrusted)
 
+	// Large bodies are for uploads only
+	app.Use(hbody.Limit)
+
 	api := app.Group("/api")
 	v1 := api.Group("/v1")
 
@@ -49,39 +53,16 @@ func New() *fiber.App {
 	rmessage.Route(v1)
 	rchannel.Route(v1)
 	rdm.Route(v1)
-	// rfile.Route(v1)
+	rsearch.Route(v1)
+	rstream.Route(v1)
+	rfile.Route(v1)
 	// rstatic.Route(v1)
 	// raccount.Route(v1)
 
 	// WS
 	ws := app.Group("/ws")
 
-	ws.Use(func(c *fiber.Ctx) error {
-		if c.Query("v") == "1.0" {
-			return c.Next()
-		}
-
-		return c.SendStatus(fiber.StatusNotFound)
-	})
-
-	ws.Use(func(c *fiber.Ctx) error {
-		if websocket.IsWebSocketUpgrade(c) {
-			return c.Next()
-		}
-		return fiber.ErrUpgradeRequired
-	})
-
-	ws.Get("/chat/:id", hjwt.ValidateAccessToken, websocket.New(func(c *websocket.Conn) {
-		channel.ChatHub.Register(c)
-		defer channel.ChatHub.Unregister(c)
-		for {
-			_, p, err := c.ReadMessage()
-			if err != nil {
-				break
-			}
-			channel.ChatHub.Broadcast(c.Params("id"), p)
-		}
-	}))
+	rws.Route(ws)
 
 	app.Use(func(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusNotFound)
@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"chatbox/pkg/settings"
+	"context"
+	"database/sql"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	mmsg "chatbox/app/model/message"
+	sattachment "chatbox/app/service/attachment"
+
+	hfile "chatbox/pkg/handler/file"
+
+	jwtv4 "github.com/golang-jwt/jwt/v4"
+)
+
+// Reserve holds the quota of the caller for the "file" form field before
+// hfile.Upload stores it, and gives it back once the chain returns. An upload
+// recorded by Upload has consumed the reservation by then.
+func Reserve(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	ownerID := int64(sub)
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		log.Print(err)
+
+		return fiber.NewError(fiber.StatusBadRequest, "Missing file")
+	}
+
+	// Files larger than the policy allows are refused by hfile.Upload
+	size := min(header.Size, settings.FileMaxSize)
+
+	reservation, err := sattachment.Reserve(ctx, ownerID, size)
+	if err != nil {
+		if err == sattachment.ErrQuotaExceeded {
+			return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Storage quota exceeded")
+		}
+
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to upload file")
+	}
+
+	c.Locals("reservation", reservation)
+
+	err = c.Next()
+
+	// ctx may have timed out while the file was stored
+	release, done := context.WithTimeout(context.Background(), settings.Timeout)
+	defer done()
+
+	if err := sattachment.Release(release, reservation); err != nil {
+		log.Print(err)
+	}
+
+	return err
+}
+
+// Upload records the file stored by hfile.Upload as an attachment of the
+// caller, in place of the quota held by Reserve. Its id is sent with a
+// message through attachment_ids.
+func Upload(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	ownerID := int64(sub)
+
+	file := c.Locals("file").(*hfile.File)
+	reservation := c.Locals("reservation").(int64)
+
+	attachment, err := sattachment.Create(ctx, &mmsg.Attachment{
+		OwnerID:     ownerID,
+		Key:         file.Key,
+		Filename:    file.Name,
+		ContentType: file.ContentType,
+		Size:        file.Size,
+		Checksum:    file.Checksum,
+	}, reservation)
+	if err != nil {
+		log.Print(err)
+
+		if err := hfile.Remove(file.Key); err != nil {
+			log.Print(err)
+		}
+
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to upload file")
+	}
+
+	// The upload returns before its previews are made
+	if attachment.PreviewStatus != nil {
+		sattachment.Enqueue(attachment.ID)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"response": attachment,
+	})
+}
+
+// Authorize lets the download of an attachment through to hfile.Download
+// when the caller may read it. ?size= downloads one of its previews instead.
+func Authorize(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	userID := int64(sub)
+
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid attachment ID")
+	}
+
+	attachment, err := sattachment.Get(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusNotFound, "Attachment not found")
+		}
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch attachment")
+	}
+
+	ok, err := sattachment.CanRead(ctx, userID, attachment)
+	if err != nil {
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check access")
+	}
+	if !ok {
+		return fiber.NewError(fiber.StatusForbidden, "Not a member of the conversation")
+	}
+
+	file := &hfile.File{
+		Key:         attachment.Key,
+		Name:        attachment.Filename,
+		ContentType: attachment.ContentType,
+		Size:        attachment.Size,
+		Checksum:    attachment.Checksum,
+	}
+
+	if size := c.Query("size"); size != "" {
+		if !thumbnailSize(size) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid size",
+			})
+		}
+
+		variant, err := sattachment.Variant(ctx, attachment.ID, size)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "Preview not available")
+			}
+			log.Print(err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch preview")
+		}
+
+		file = &hfile.File{
+			Key:         variant.Key,
+			Name:        variantName(attachment.Filename, variant),
+			ContentType: variant.ContentType,
+			Size:        variant.Size,
+		}
+	}
+
+	c.Set(fiber.HeaderCacheControl, "private")
+
+	c.Locals("file", file)
+
+	return c.Next()
+}
+
+// thumbnailSize reports whether name is one of sattachment.ThumbnailSizes.
+func thumbnailSize(name string) bool {
+	for _, size := range sattachment.ThumbnailSizes {
+		if size.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// variantName names a preview after the file it was made from, e.g.
+// photo_small.jpg for photo.jpeg.
+func variantName(filename string, variant *mmsg.AttachmentVariant) string {
+	ext := ".jpg"
+	if variant.ContentType == "image/png" {
+		ext = ".png"
+	}
+
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "_" + variant.Name + ext
+}
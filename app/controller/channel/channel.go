@@ -3,15 +3,21 @@ package controller
 import (
 	"chatbox/pkg/settings"
 	"context"
+	"database/sql"
 	"log"
 	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 
+	"chatbox/pkg/channel"
 	"chatbox/pkg/util/validate"
 
 	mchannel "chatbox/app/model/channel"
+	mmsg "chatbox/app/model/message"
+	mnotification "chatbox/app/model/notification"
 	schannel "chatbox/app/service/channel"
+	smsg "chatbox/app/service/message"
+	snotification "chatbox/app/service/notification"
 
 	jwtv4 "github.com/golang-jwt/jwt/v4"
 )
@@ -42,14 +48,35 @@ func CreateChannel(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"response": invalid})
 	}
 
-	channel, err := schannel.Insert(ctx, payload.Name, createdBy, payload.UserIDs)
+	created, err := schannel.Insert(ctx, payload.Name, createdBy, payload.UserIDs)
 	if err != nil {
 		log.Print(err)
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create channel")
 	}
 
+	var invited []int64
+	for _, memberID := range payload.UserIDs {
+		if memberID != createdBy {
+			invited = append(invited, memberID)
+		}
+	}
+
+	for _, memberID := range created.UserIDs {
+		if err := channel.ChatHub.Admit(channel.ChannelRoom(created.ID), memberID); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if err := snotification.Invite(invited, &mnotification.Invite{
+		ChannelID: created.ID,
+		Name:      created.Name,
+		InvitedBy: createdBy,
+	}); err != nil {
+		log.Print(err)
+	}
+
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"response": channel,
+		"response": created,
 	})
 }
 
@@ -107,6 +134,13 @@ func GetChannelDetailsByID(c *fiber.Ctx) error {
 }
 
 func AddMemberToChannel(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	invitedBy := int64(sub)
+
 	var req mchannel.AddMemberRequest
 
 	if err := c.BodyParser(&req); err != nil {
@@ -134,6 +168,25 @@ func AddMemberToChannel(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to add member to channel")
 	}
 
+	if err := channel.ChatHub.Admit(channel.ChannelRoom(req.ID), req.MemberID); err != nil {
+		log.Print(err)
+	}
+
+	details, err := schannel.GetDetailsByID(ctx, req.ID)
+	if err != nil {
+		log.Println("Failed to get channel:", err)
+	} else {
+		notifyMembership(ctx, req.ID, req.MemberID, mnotification.ActionJoined)
+
+		if err := snotification.Invite([]int64{req.MemberID}, &mnotification.Invite{
+			ChannelID: details.ID,
+			Name:      details.Name,
+			InvitedBy: invitedBy,
+		}); err != nil {
+			log.Print(err)
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"message": "Member added successfully",
 	})
@@ -160,6 +213,12 @@ func LeaveChannel(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to leave channel")
 	}
 
+	if err := channel.ChatHub.Kick(channel.ChannelRoom(payload.ID), userID); err != nil {
+		log.Print(err)
+	}
+
+	notifyMembership(ctx, payload.ID, userID, mnotification.ActionLeft)
+
 	return c.JSON(fiber.Map{"message": "Left the channel successfully"})
 }
 
@@ -183,9 +242,97 @@ func DeleteChannel(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusForbidden, "Only the channel creator can delete the channel")
 	}
 
+	memberIDs, err := schannel.GetMemberIDs(ctx, channelID)
+	if err != nil {
+		log.Println("Failed to get channel members:", err)
+	}
+
 	if err := schannel.Delete(ctx, channelID); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to delete channel")
 	}
 
+	if err := channel.ChatHub.CloseRoom(channel.ChannelRoom(channelID)); err != nil {
+		log.Print(err)
+	}
+
+	if err := snotification.Membership(memberIDs, &mnotification.Membership{
+		ChannelID: channelID,
+		UserID:    userID,
+		Action:    mnotification.ActionDeleted,
+	}); err != nil {
+		log.Print(err)
+	}
+
 	return c.JSON(fiber.Map{"message": "Channel deleted successfully"})
 }
+
+// notifyMembership tells the current members of a channel that userID
+// joined or left it.
+func notifyMembership(ctx context.Context, channelID, userID int64, action string) {
+	memberIDs, err := schannel.GetMemberIDs(ctx, channelID)
+	if err != nil {
+		log.Println("Failed to get channel members:", err)
+		return
+	}
+
+	var others []int64
+	for _, memberID := range memberIDs {
+		if memberID != userID {
+			others = append(others, memberID)
+		}
+	}
+
+	if err := snotification.Membership(others, &mnotification.Membership{
+		ChannelID: channelID,
+		UserID:    userID,
+		Action:    action,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+// MarkChannelRead moves the read position of the caller in a channel up to a
+// message, or to the latest message when none is given.
+func MarkChannelRead(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+	claims := c.Locals("claims").(jwtv4.MapClaims)
+	userID := int64(claims["sub"].(float64))
+	channelID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid channel ID")
+	}
+
+	payload := new(mmsg.ReadPayload)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(payload); err != nil {
+			log.Print(err)
+			return c.SendStatus(fiber.StatusUnprocessableEntity)
+		}
+	}
+
+	isMember, err := schannel.IsMember(channelID, userID)
+	if err != nil {
+		log.Println("Error checking membership:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check membership")
+	}
+	if !isMember {
+		return fiber.NewError(fiber.StatusForbidden, "Not a member of the channel")
+	}
+
+	lastReadID, err := smsg.MarkRead(ctx, userID, "channel", channelID, payload.MessageID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusNotFound, "Message not found")
+		}
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to mark channel as read")
+	}
+
+	return c.JSON(fiber.Map{
+		"response": fiber.Map{"last_read_id": lastReadID},
+	})
+}
@@ -3,9 +3,13 @@ package service
 import (
 	"chatbox/pkg/settings"
 	"context"
+	"database/sql"
 	"log"
+	"strconv"
 
+	mmsg "chatbox/app/model/message"
 	sdm "chatbox/app/service/dm"
+	smsg "chatbox/app/service/message"
 
 	"github.com/gofiber/fiber/v2"
 	jwtv4 "github.com/golang-jwt/jwt/v4"
@@ -40,3 +44,51 @@ func GetUserDMList(c *fiber.Ctx) error {
 		"response": dms,
 	})
 }
+
+// MarkDMRead moves the read position of the caller in the direct messages
+// with another user up to a message, or to the latest message when none is
+// given. The other user sees it as the counterpart read position.
+func MarkDMRead(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+	claims, ok := c.Locals("claims").(jwtv4.MapClaims)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid token claims")
+	}
+
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid subject in token")
+	}
+
+	userID := int64(sub)
+
+	otherID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid user ID")
+	}
+
+	payload := new(mmsg.ReadPayload)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(payload); err != nil {
+			log.Print(err)
+			return c.SendStatus(fiber.StatusUnprocessableEntity)
+		}
+	}
+
+	lastReadID, err := smsg.MarkRead(ctx, userID, "user", otherID, payload.MessageID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusNotFound, "Message not found")
+		}
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to mark messages as read")
+	}
+
+	return c.JSON(fiber.Map{
+		"response": fiber.Map{"last_read_id": lastReadID},
+	})
+}
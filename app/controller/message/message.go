@@ -4,6 +4,7 @@ import (
 	"chatbox/pkg/settings"
 	"chatbox/pkg/util/validate"
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"strconv"
@@ -12,6 +13,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 
 	mmsg "chatbox/app/model/message"
+	schannel "chatbox/app/service/channel"
 	smsg "chatbox/app/service/message"
 
 	jwtv4 "github.com/golang-jwt/jwt/v4"
@@ -37,7 +39,7 @@ func SendMessage(c *fiber.Ctx) error {
 	// Set the authenticated sender ID
 	msg.Sender.ID = senderID
 
-	// Validate required fields (receiver_id, receiver_class, message)
+	// Validate required fields (receiver_id, receiver_class)
 	if invalid := validate.All(msg); len(invalid) > 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"response": invalid})
 	}
@@ -50,18 +52,36 @@ func SendMessage(c *fiber.Ctx) error {
 		})
 	}
 
-	// Insert the message
-	result, err := smsg.Insert(ctx, msg)
+	// Only members may post to a channel
+	if msg.ReceiverClass == "channel" {
+		isMember, err := schannel.IsMember(*msg.ReceiverID, senderID)
+		if err != nil {
+			log.Println("Error checking membership:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to check membership")
+		}
+		if !isMember {
+			return fiber.NewError(fiber.StatusForbidden, "Not a member of the channel")
+		}
+	}
+
+	// Store the message and deliver it to the room
+	result, err := smsg.Send(ctx, msg, c.Get("X-Client-ID"))
 	if err != nil {
+		switch err {
+		case smsg.ErrEmpty:
+			return fiber.NewError(fiber.StatusBadRequest, "A message needs text or attachment_ids")
+		case smsg.ErrInvalidParent:
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid parent_id. Replies must be to a message of the same conversation that is not a reply")
+		case smsg.ErrInvalidAttachment:
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid attachment_ids. Attachments must be uploaded by the sender and not sent yet")
+		}
+
 		log.Print(err)
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to send message")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"response": fiber.Map{
-			"id":      result.ID,
-			"sent_at": result.SentAt,
-		},
+		"response": result,
 	})
 }
 
@@ -80,69 +100,236 @@ func GetMessages(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "Invalid query parameters")
 	}
 
+	// Validate receiver_class
+	if query.ReceiverClass == nil || *query.ReceiverClass != "user" && *query.ReceiverClass != "channel" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or missing receiver_class. Must be 'user' or 'channel'.",
+		})
+	}
+
+	if query.ReceiverID == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing receiver_id.",
+		})
+	}
+
+	// Only members may read a channel
+	if *query.ReceiverClass == "channel" {
+		isMember, err := schannel.IsMember(*query.ReceiverID, requestBy)
+		if err != nil {
+			log.Println("Error checking membership:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to check membership")
+		}
+		if !isMember {
+			return fiber.NewError(fiber.StatusForbidden, "Not a member of the channel")
+		}
+	}
+
+	// Columns of the message table of receiver_class
+	table := "dm"
+	if *query.ReceiverClass == "channel" {
+		table = "chm"
+	}
+
 	filter := map[string][]string{
 		"or":  {},
 		"and": {},
 	}
-	args := []interface{}{}
+
+	// The "and" filters come first in the query, so their args are kept apart
+	// and placed before the "or" args
+	andArgs, orArgs := []interface{}{}, []interface{}{}
 
 	// Fulltext search
 	if q := strings.TrimSpace(c.Query("q")); q != "" {
 		for _, field := range []string{"message", "sender.firstname", "sender.lastname", "sender.username"} {
 			filter["or"] = append(filter["or"], fmt.Sprintf("%s ILIKE ?", field))
-			args = append(args, "%"+q+"%")
+			orArgs = append(orArgs, "%"+q+"%")
 		}
-	}
 
-	// Validate receiver_class
-	if query.ReceiverClass == nil || *query.ReceiverClass != "user" && *query.ReceiverClass != "channel" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid or missing receiver_class. Must be 'user' or 'channel'.",
-		})
+		// Deleted messages never match a search
+		filter["and"] = append(filter["and"], table+".deleted_at IS NULL")
 	}
 
+	// Thread replies are listed with GET /message/:id/thread
+	filter["and"] = append(filter["and"], table+".parent_id IS NULL")
+
 	// Build filters based on receiver type
-	if query.ReceiverID != nil {
-		switch *query.ReceiverClass {
-		case "user":
-			filter["or"] = append(filter["or"],
-				"((dm.sender_id = ? AND dm.receiver_id = ?) OR (dm.sender_id = ? AND dm.receiver_id = ?))",
-			)
-			args = append(args, requestBy, *query.ReceiverID, *query.ReceiverID, requestBy)
+	switch *query.ReceiverClass {
+	case "user":
+		filter["and"] = append(filter["and"],
+			"((dm.sender_id = ? AND dm.receiver_id = ?) OR (dm.sender_id = ? AND dm.receiver_id = ?))",
+		)
+		andArgs = append(andArgs, requestBy, *query.ReceiverID, *query.ReceiverID, requestBy)
 
-		case "channel":
-			filter["and"] = append(filter["and"], "chm.channel_id = ?")
-			args = append(args, *query.ReceiverID)
-		}
+	case "channel":
+		filter["and"] = append(filter["and"], "chm.channel_id = ?")
+		andArgs = append(andArgs, *query.ReceiverID)
 	}
 
 	// Date filters
 	if query.Created.Gte != nil {
 		filter["and"] = append(filter["and"], "sent_at >= ?")
-		args = append(args, *query.Created.Gte)
+		andArgs = append(andArgs, *query.Created.Gte)
 	}
 	if query.Created.Lte != nil {
 		filter["and"] = append(filter["and"], "sent_at <= ?")
-		args = append(args, *query.Created.Lte)
+		andArgs = append(andArgs, *query.Created.Lte)
 	}
 
 	// Clean up empty filters
 	if len(filter["or"]) == 0 {
 		delete(filter, "or")
 	}
-	if len(filter["and"]) == 0 {
-		delete(filter, "and")
+
+	// fetch runs the query with an extra "and" condition
+	fetch := func(cond string, condArgs []interface{}, order, sort string, limit, offset int) ([]mmsg.Message, error) {
+		f := map[string][]string{
+			"and": append(append([]string{}, filter["and"]...), cond),
+			"or":  filter["or"],
+		}
+
+		args := append(append(append([]interface{}{}, andArgs...), condArgs...), orArgs...)
+
+		if *query.ReceiverClass == "user" {
+			return smsg.FetchDirectMessages(ctx, requestBy, *query.ReceiverID, f, args, order, sort, limit, offset)
+		}
+
+		return smsg.FetchChannelMessages(ctx, requestBy, *query.ReceiverID, f, args, order, sort, limit, offset)
 	}
 
-	// Pagination and sorting
-	page, _ := strconv.Atoi(c.Query("page", "1"))
-	if page <= 0 {
-		page = 1
+	// Only the number of matching messages
+	if preferTotalOnly(c) {
+		var (
+			total int64
+			err   error
+		)
+
+		args := append(append([]interface{}{}, andArgs...), orArgs...)
+
+		switch *query.ReceiverClass {
+		case "user":
+			total, err = smsg.CountDirectMessages(ctx, filter, args)
+		case "channel":
+			total, err = smsg.CountChannelMessages(ctx, *query.ReceiverID, filter, args)
+		}
+
+		if err != nil {
+			log.Print(err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to count messages")
+		}
+
+		return c.JSON(fiber.Map{
+			"total": total,
+		})
 	}
+
 	limit, _ := strconv.Atoi(c.Query("limit", "10"))
 	if limit <= 0 || limit > 100 {
 		limit = 10
 	}
+
+	// Keyset pagination
+	cursor, around, err := pageCursor(ctx, c, requestBy, *query.ReceiverClass, *query.ReceiverID)
+	if err != nil {
+		switch err {
+		case smsg.ErrInvalidCursor:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid cursor.",
+			})
+		case sql.ErrNoRows:
+			return fiber.NewError(fiber.StatusNotFound, "Message not found")
+		}
+
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch messages")
+	}
+
+	if cursor != nil || around != nil {
+		var (
+			messages     []mmsg.Message
+			older, newer bool
+		)
+
+		keyset := fmt.Sprintf("(%s.sent_at, %[1]s.id)", table)
+
+		switch {
+		case around != nil:
+			// The anchor opens the page, up to half of which is older
+			before, err := fetch(keyset+" <= (?, ?)", []interface{}{around.SentAt, around.ID}, "sent_at", "DESC", (limit+1)/2+1, 0)
+			if err != nil {
+				log.Print(err)
+				return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch messages")
+			}
+			before, older = trimPage(before, (limit+1)/2)
+
+			after, err := fetch(keyset+" > (?, ?)", []interface{}{around.SentAt, around.ID}, "sent_at", "ASC", limit-len(before)+1, 0)
+			if err != nil {
+				log.Print(err)
+				return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch messages")
+			}
+			after, newer = trimPage(after, limit-len(before))
+
+			messages = append(reversePage(before), after...)
+
+		case cursor.Direction == smsg.CursorBefore:
+			cond, condArgs := "TRUE", []interface{}{}
+			if cursor.ID != 0 {
+				cond, condArgs = keyset+" < (?, ?)", []interface{}{cursor.SentAt, cursor.ID}
+			}
+
+			messages, err = fetch(cond, condArgs, "sent_at", "DESC", limit+1, 0)
+			if err != nil {
+				log.Print(err)
+				return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch messages")
+			}
+			messages, older = trimPage(messages, limit)
+			messages = reversePage(messages)
+
+			// Pages that end at the latest message have nothing newer
+			newer = cursor.ID != 0
+
+		default:
+			messages, err = fetch(keyset+" > (?, ?)", []interface{}{cursor.SentAt, cursor.ID}, "sent_at", "ASC", limit+1, 0)
+			if err != nil {
+				log.Print(err)
+				return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch messages")
+			}
+			messages, newer = trimPage(messages, limit)
+			older = true
+		}
+
+		var prev, next *string
+		if len(messages) > 0 {
+			if older {
+				first := messages[0]
+				prev = new(string)
+				*prev = smsg.EncodeCursor(mmsg.Cursor{Direction: smsg.CursorBefore, SentAt: first.SentAt, ID: first.ID})
+			}
+			if newer {
+				last := messages[len(messages)-1]
+				next = new(string)
+				*next = smsg.EncodeCursor(mmsg.Cursor{Direction: smsg.CursorAfter, SentAt: last.SentAt, ID: last.ID})
+			}
+		}
+
+		if messages == nil {
+			messages = []mmsg.Message{}
+		}
+
+		return c.JSON(fiber.Map{
+			"response":    messages,
+			"count":       len(messages),
+			"prev_cursor": prev,
+			"next_cursor": next,
+		})
+	}
+
+	// Pagination and sorting
+	page, _ := strconv.Atoi(c.Query("page", "1"))
+	if page <= 0 {
+		page = 1
+	}
 	offset := (page - 1) * limit
 
 	sorts := strings.Split(c.Query("sort"), ",")
@@ -158,26 +345,409 @@ func GetMessages(c *fiber.Ctx) error {
 	}
 
 	// Fetch messages
+	messages, err := fetch("TRUE", nil, order, sort, limit, offset)
+	if err != nil {
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch messages")
+	}
+
+	return c.JSON(fiber.Map{
+		"response": messages,
+		"total":    len(messages),
+	})
+}
+
+// preferTotalOnly reports whether the request asks for the total count alone
+// through the Prefer header.
+func preferTotalOnly(c *fiber.Ctx) bool {
+	for _, pref := range strings.Split(c.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(pref), settings.PreferTotalOnly) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pageCursor returns the keyset position a request pages from: the cursor
+// query, or a before or after message id, or the message to center a page
+// around. A before of "latest" pages back from the latest message. Both are
+// nil for offset pagination.
+func pageCursor(ctx context.Context, c *fiber.Ctx, userID int64, receiverClass string, receiverID int64) (*mmsg.Cursor, *mmsg.Cursor, error) {
+	if s := c.Query("cursor"); s != "" {
+		cursor, err := smsg.DecodeCursor(s)
+		return cursor, nil, err
+	}
+
+	if c.Query("before") == "latest" {
+		return &mmsg.Cursor{Direction: smsg.CursorBefore}, nil, nil
+	}
+
+	for _, direction := range []string{smsg.CursorBefore, smsg.CursorAfter, "around"} {
+		s := c.Query(direction)
+		if s == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, nil, smsg.ErrInvalidCursor
+		}
+
+		anchor, err := smsg.Anchor(ctx, userID, receiverClass, receiverID, id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if direction == "around" {
+			return nil, anchor, nil
+		}
+
+		anchor.Direction = direction
+		return anchor, nil, nil
+	}
+
+	return nil, nil, nil
+}
+
+// trimPage cuts messages, fetched with one extra row, down to limit and
+// reports whether there were more.
+func trimPage(messages []mmsg.Message, limit int) ([]mmsg.Message, bool) {
+	if len(messages) > limit {
+		return messages[:limit], true
+	}
+
+	return messages, false
+}
+
+// reversePage reverses messages in place.
+func reversePage(messages []mmsg.Message) []mmsg.Message {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages
+}
+
+// EditMessage replaces the text of a message of the caller within the edit
+// window and keeps the prior text in the edit history.
+func EditMessage(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+	c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	senderID := int64(sub)
+
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid message ID")
+	}
+
+	payload := new(mmsg.EditPayload)
+	if err := c.BodyParser(payload); err != nil {
+		log.Print(err)
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	if invalid := validate.All(payload); len(invalid) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"response": invalid})
+	}
+
+	payload.ReceiverClass = strings.ToLower(payload.ReceiverClass)
+	if payload.ReceiverClass != "user" && payload.ReceiverClass != "channel" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid receiver_class. Must be 'user' or 'channel'.",
+		})
+	}
+
+	result, err := smsg.Edit(ctx, id, payload.ReceiverClass, senderID, payload.Message, c.Get("X-Client-ID"))
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return fiber.NewError(fiber.StatusNotFound, "Message not found")
+		case smsg.ErrNotSender:
+			return fiber.NewError(fiber.StatusForbidden, "Only the sender may edit a message")
+		case smsg.ErrNotMember:
+			return fiber.NewError(fiber.StatusForbidden, "Not a member of the channel")
+		case smsg.ErrEditWindow:
+			return fiber.NewError(fiber.StatusForbidden, "Edit window has passed")
+		}
+
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to edit message")
+	}
+
+	return c.JSON(fiber.Map{
+		"response": result,
+	})
+}
+
+// GetEditHistory returns the prior versions of a channel message to the
+// admins of the channel.
+func GetEditHistory(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+	c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	requestBy := int64(sub)
+
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid message ID")
+	}
+
+	if strings.ToLower(c.Query("receiver_class", "channel")) != "channel" {
+		return fiber.NewError(fiber.StatusForbidden, "Edit history is only available to channel admins")
+	}
+
+	channelID, err := smsg.ChannelID(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusNotFound, "Message not found")
+		}
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to retrieve message")
+	}
+
+	isAdmin, err := schannel.IsAdmin(ctx, channelID, requestBy)
+	if err != nil {
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check membership")
+	}
+	if !isAdmin {
+		return fiber.NewError(fiber.StatusForbidden, "Edit history is only available to channel admins")
+	}
+
+	edits, err := smsg.EditHistory(ctx, id, "channel")
+	if err != nil {
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch edit history")
+	}
+
+	return c.JSON(fiber.Map{
+		"response": edits,
+		"total":    len(edits),
+	})
+}
+
+// DeleteMessage removes a message of the caller, or any message of a channel
+// the caller is an admin of. The message stays as a tombstone without text.
+func DeleteMessage(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+	c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	requestBy := int64(sub)
+
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid message ID")
+	}
+
+	receiverClass := strings.ToLower(c.Query("receiver_class"))
+	if receiverClass != "user" && receiverClass != "channel" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or missing receiver_class. Must be 'user' or 'channel'.",
+		})
+	}
+
+	result, err := smsg.Delete(ctx, id, receiverClass, requestBy, c.Get("X-Client-ID"))
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return fiber.NewError(fiber.StatusNotFound, "Message not found")
+		case smsg.ErrNotPermitted:
+			return fiber.NewError(fiber.StatusForbidden, "Only the sender or a channel admin may delete a message")
+		}
+
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to delete message")
+	}
+
+	return c.JSON(fiber.Map{
+		"response": result,
+	})
+}
+
+// GetThread returns the message that started a thread and a page of its
+// replies, oldest first.
+func GetThread(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	requestBy := int64(sub)
+
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid message ID")
+	}
+
+	receiverClass := strings.ToLower(c.Query("receiver_class"))
+	if receiverClass != "user" && receiverClass != "channel" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or missing receiver_class. Must be 'user' or 'channel'.",
+		})
+	}
+
+	// A deleted parent is returned as a tombstone, its replies stay readable
+	sender, receiverID, _, err := smsg.LocateAny(ctx, id, receiverClass)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusNotFound, "Message not found")
+		}
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to retrieve message")
+	}
+
+	// Only the participants of the conversation may read the thread
+	switch receiverClass {
+	case "user":
+		if requestBy != sender && requestBy != receiverID {
+			return fiber.NewError(fiber.StatusNotFound, "Message not found")
+		}
+
+	case "channel":
+		isMember, err := schannel.IsMember(receiverID, requestBy)
+		if err != nil {
+			log.Println("Error checking membership:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to check membership")
+		}
+		if !isMember {
+			return fiber.NewError(fiber.StatusForbidden, "Not a member of the channel")
+		}
+	}
+
+	page, _ := strconv.Atoi(c.Query("page", "1"))
+	if page <= 0 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.Query("limit", "10"))
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+	offset := (page - 1) * limit
+
 	var (
-		messages []mmsg.Message
-		err      error
+		parent  []mmsg.Message
+		replies []mmsg.Message
 	)
 
-	switch *query.ReceiverClass {
+	switch receiverClass {
 	case "user":
-		messages, err = smsg.FetchDirectMessages(ctx, requestBy, *query.ReceiverID, filter, args, order, sort, limit, offset)
+		other := receiverID
+		if requestBy == receiverID {
+			other = sender
+		}
+
+		parent, err = smsg.FetchDirectMessages(ctx, requestBy, other, map[string][]string{"and": {"dm.id = ?"}}, []interface{}{id}, "dm.id", "ASC", 1, 0)
+		if err == nil {
+			replies, err = smsg.FetchDirectMessages(ctx, requestBy, other, map[string][]string{"and": {"dm.parent_id = ?"}}, []interface{}{id}, "dm.id", "ASC", limit, offset)
+		}
 
 	case "channel":
-		messages, err = smsg.FetchChannelMessages(ctx, *query.ReceiverID, filter, args, order, sort, limit, offset)
+		parent, err = smsg.FetchChannelMessages(ctx, requestBy, receiverID, map[string][]string{"and": {"chm.id = ?"}}, []interface{}{id}, "chm.id", "ASC", 1, 0)
+		if err == nil {
+			replies, err = smsg.FetchChannelMessages(ctx, requestBy, receiverID, map[string][]string{"and": {"chm.parent_id = ?"}}, []interface{}{id}, "chm.id", "ASC", limit, offset)
+		}
 	}
 
 	if err != nil {
 		log.Print(err)
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch messages")
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch thread")
+	}
+
+	if len(parent) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "Message not found")
+	}
+
+	// Deleted replies are paged as tombstones, but left out of the reply
+	// count of the thread summary
+	total, deleted, err := smsg.CountReplies(ctx, id, receiverClass)
+	if err != nil {
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to count replies")
 	}
 
 	return c.JSON(fiber.Map{
-		"response": messages,
-		"total":    len(messages),
+		"parent":   parent[0],
+		"response": replies,
+		"total":    total,
+		"deleted":  deleted,
 	})
 }
+
+// AddReaction reacts to a message with an emoji on behalf of the caller.
+func AddReaction(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+	payload := new(mmsg.ReactionPayload)
+	if err := c.BodyParser(payload); err != nil {
+		log.Print(err)
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	if invalid := validate.All(payload); len(invalid) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"response": invalid})
+	}
+
+	return react(c, payload, true)
+}
+
+// RemoveReaction withdraws the reaction of the caller with an emoji.
+func RemoveReaction(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+	payload := &mmsg.ReactionPayload{
+		Emoji:         c.Query("emoji"),
+		ReceiverClass: c.Query("receiver_class"),
+	}
+
+	return react(c, payload, false)
+}
+
+func react(c *fiber.Ctx, payload *mmsg.ReactionPayload, add bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	requestBy := int64(sub)
+
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid message ID")
+	}
+
+	receiverClass := strings.ToLower(payload.ReceiverClass)
+	if receiverClass != "user" && receiverClass != "channel" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or missing receiver_class. Must be 'user' or 'channel'.",
+		})
+	}
+
+	if !smsg.ValidEmoji(payload.Emoji) {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid emoji. Must be a :shortcode: or a unicode emoji")
+	}
+
+	if err := smsg.React(ctx, id, receiverClass, requestBy, payload.Emoji, add, c.Get("X-Client-ID")); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return fiber.NewError(fiber.StatusNotFound, "Message not found")
+		case smsg.ErrNotMember:
+			return fiber.NewError(fiber.StatusForbidden, "Not a member of the channel")
+		}
+
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to update reaction")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
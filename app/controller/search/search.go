@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"chatbox/pkg/settings"
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	ssearch "chatbox/app/service/search"
+
+	jwtv4 "github.com/golang-jwt/jwt/v4"
+)
+
+// SearchMessages searches every direct message and channel message the
+// caller can read.
+func SearchMessages(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	userID := int64(sub)
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing q.",
+		})
+	}
+
+	query, err := ssearch.Parse(q)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Pagination
+	page, _ := strconv.Atoi(c.Query("page", "1"))
+	if page <= 0 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.Query("limit", "20"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	results, err := ssearch.Messages(ctx, userID, query, limit, offset)
+	if err != nil {
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to search messages")
+	}
+
+	total, err := ssearch.Count(ctx, userID, query)
+	if err != nil {
+		log.Print(err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to count messages")
+	}
+
+	return c.JSON(fiber.Map{
+		"response": results,
+		"total":    total,
+	})
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/utils"
@@ -13,6 +15,8 @@ import (
 
 	jwtv4 "github.com/golang-jwt/jwt/v4"
 
+	"chatbox/pkg/channel"
+	"chatbox/pkg/channel/presence"
 	"chatbox/pkg/jwt"
 	"chatbox/pkg/settings"
 	"chatbox/pkg/util"
@@ -287,6 +291,11 @@ func GetUsers(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to retrieve users")
 	}
 
+	for _, user := range users {
+		p := lookupPresence(int64(user.Id), user.LastSeenAt)
+		user.Status, user.LastSeenAt = p.Status, p.LastSeenAt
+	}
+
 	return c.JSON(fiber.Map{
 		"response": users,
 	})
@@ -312,11 +321,73 @@ func GetUserDetails(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to retrieve user")
 	}
 
+	p := lookupPresence(userID, user.LastSeenAt)
+	user.Status, user.LastSeenAt = p.Status, p.LastSeenAt
+
 	return c.JSON(fiber.Map{
 		"response": user,
 	})
 }
 
+func GetPresence(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+
+	defer cancel()
+
+	c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+	var userIDs []int64
+
+	for _, field := range strings.Split(c.Query("ids"), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid user ID")
+		}
+
+		userIDs = append(userIDs, id)
+	}
+
+	if len(userIDs) == 0 || len(userIDs) > 100 {
+		return fiber.NewError(fiber.StatusBadRequest, "ids must list between 1 and 100 user IDs")
+	}
+
+	lastSeen, err := suser.GetLastSeen(ctx, userIDs)
+	if err != nil {
+		log.Println("Failed to retrieve last seen:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to retrieve presence")
+	}
+
+	response := make([]*presence.Presence, 0, len(userIDs))
+
+	for _, id := range userIDs {
+		var lastSeenAt *time.Time
+		if t, ok := lastSeen[id]; ok {
+			lastSeenAt = &t
+		}
+
+		response = append(response, lookupPresence(id, lastSeenAt))
+	}
+
+	return c.JSON(fiber.Map{
+		"response": response,
+	})
+}
+
+// lookupPresence returns the live presence of userID, falling back to the
+// stored last seen time for users this process has not seen.
+func lookupPresence(userID int64, lastSeenAt *time.Time) *presence.Presence {
+	p, ok := channel.ChatPresence.Get(userID)
+	if !ok || p.LastSeenAt == nil {
+		p.LastSeenAt = lastSeenAt
+	}
+
+	return p
+}
+
 func GetCurrentUser(c *fiber.Ctx) error {
 	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
 
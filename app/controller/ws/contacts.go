@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"chatbox/pkg/settings"
+
+	suser "chatbox/app/service/user"
+)
+
+// contactCache keeps the contacts of users whose presence changed, so that a
+// user going idle and back is not a scan of their direct messages each time.
+// Contacts gained meanwhile are told of changes once the entry expires.
+type contactCache struct {
+	mutex   sync.Mutex
+	entries map[int64]*contactEntry
+}
+
+type contactEntry struct {
+	ids       []int64
+	expiresAt time.Time
+}
+
+var contacts = contactCache{entries: make(map[int64]*contactEntry)}
+
+// get returns the contacts of userID, from the cache while they are fresh.
+func (cc *contactCache) get(ctx context.Context, userID int64) ([]int64, error) {
+	now := time.Now()
+
+	cc.mutex.Lock()
+	entry, ok := cc.entries[userID]
+	cc.mutex.Unlock()
+
+	if ok && now.Before(entry.expiresAt) {
+		return entry.ids, nil
+	}
+
+	ids, err := suser.GetContactIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	// Expired entries go as new ones come, so only users active within the
+	// TTL are kept
+	for id, entry := range cc.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(cc.entries, id)
+		}
+	}
+
+	cc.entries[userID] = &contactEntry{ids: ids, expiresAt: now.Add(settings.PresenceContactsTTL)}
+
+	return ids, nil
+}
@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"context"
+	"sync"
+)
+
+// sessionGroup counts the socket and stream handlers still running. fasthttp
+// serves them on hijacked connections, outside the requests app.Shutdown
+// waits for. Unlike a sync.WaitGroup, a session may start while Wait runs.
+type sessionGroup struct {
+	mutex sync.Mutex
+	count int
+	// Closed once count drops to zero
+	idle chan struct{}
+}
+
+var sessions sessionGroup
+
+func (g *sessionGroup) add() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.count == 0 {
+		g.idle = make(chan struct{})
+	}
+
+	g.count++
+}
+
+func (g *sessionGroup) done() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.count--
+
+	if g.count == 0 {
+		close(g.idle)
+	}
+}
+
+// Wait blocks until every socket and stream handler has returned, so none is
+// left using the database when it is closed.
+func Wait(ctx context.Context) error {
+	sessions.mutex.Lock()
+
+	if sessions.count == 0 {
+		sessions.mutex.Unlock()
+		return nil
+	}
+
+	idle := sessions.idle
+	sessions.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
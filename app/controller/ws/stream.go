@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"bufio"
+	"log"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+
+	jwtv4 "github.com/golang-jwt/jwt/v4"
+
+	"chatbox/pkg/channel"
+	"chatbox/pkg/channel/hub"
+	"chatbox/pkg/channel/stream"
+)
+
+// ChatStream serves the room resolved by Authorize as Server-Sent Events, for
+// clients whose proxies do not pass websocket upgrades. Events use the same
+// envelope as the chat socket; the stream is one-way, so messages are sent
+// through the REST API.
+func ChatStream(c *fiber.Ctx) error {
+	s := new(session)
+	s.room, _ = c.Locals("room").(string)
+	s.userID, _ = c.Locals("user_id").(int64)
+	s.receiverID, _ = c.Locals("receiver_id").(int64)
+	s.receiverClass, _ = c.Locals("receiver_class").(string)
+	s.hub = channel.ChatHub
+
+	since, replay := c.Locals("since").(int64)
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	expiry := expiresAt(claims)
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	// The writer is started right away, so it always marks the session done
+	sessions.add()
+
+	// The writer runs after the handler returns and lasts as long as the
+	// client stays registered
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer sessions.done()
+
+		if replay {
+			s.client = channel.ChatHub.RegisterHeld(stream.New(w), s.userID, s.room)
+		} else {
+			s.client = channel.ChatHub.Register(stream.New(w), s.userID, s.room)
+		}
+		defer channel.ChatHub.Unregister(s.client)
+
+		if replay {
+			if err := s.replay(since); err != nil {
+				if err != errClosed {
+					log.Print(err)
+					s.client.Close(websocket.CloseInternalServerErr, "replay failed")
+				}
+				return
+			}
+		}
+
+		// Streams cannot authenticate in-band, clients reconnect with a
+		// fresh token instead
+		timer := time.AfterFunc(time.Until(expiry), func() {
+			s.client.Close(hub.CloseTokenExpired, "token expired")
+		})
+		defer timer.Stop()
+
+		<-s.client.Done()
+	})
+
+	return nil
+}
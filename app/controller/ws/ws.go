@@ -0,0 +1,903 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+
+	jwtv4 "github.com/golang-jwt/jwt/v4"
+
+	"chatbox/pkg/channel"
+	"chatbox/pkg/channel/event"
+	"chatbox/pkg/channel/hub"
+	"chatbox/pkg/channel/presence"
+	"chatbox/pkg/channel/ratelimit"
+	"chatbox/pkg/jwt"
+	"chatbox/pkg/settings"
+	"chatbox/pkg/util/validate"
+
+	mmsg "chatbox/app/model/message"
+	schannel "chatbox/app/service/channel"
+	smsg "chatbox/app/service/message"
+	suser "chatbox/app/service/user"
+)
+
+// Authorize resolves the requested room to a channel or a DM pair and
+// rejects the upgrade unless the caller belongs to it.
+func Authorize(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	claims, ok := c.Locals("claims").(jwtv4.MapClaims)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid token claims")
+	}
+
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid subject in token")
+	}
+
+	userID := int64(sub)
+
+	receiverID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid receiver ID")
+	}
+
+	room, err := resolve(ctx, userID, receiverID, strings.ToLower(c.Query("receiver_class")))
+	if err != nil {
+		return err
+	}
+
+	// Missed messages after since are replayed before live delivery. Event
+	// streams resume from the Last-Event-ID their client sends back.
+	since := c.Query("since")
+	if id := c.Get("Last-Event-ID"); id != "" {
+		since = id
+	}
+
+	if since != "" {
+		id, err := strconv.ParseInt(since, 10, 64)
+		if err != nil || id < 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid since message ID")
+		}
+
+		c.Locals("since", id)
+	}
+
+	c.Locals("user_id", userID)
+	c.Locals("receiver_id", receiverID)
+	c.Locals("receiver_class", strings.ToLower(c.Query("receiver_class")))
+	c.Locals("room", room)
+
+	return c.Next()
+}
+
+// resolve returns the room of the conversation of userID with a channel or
+// another user, provided userID may join it. Failures are *fiber.Error.
+func resolve(ctx context.Context, userID, receiverID int64, receiverClass string) (string, error) {
+	switch receiverClass {
+	case "channel":
+		isMember, err := schannel.IsMember(receiverID, userID)
+		if err != nil {
+			log.Println("Error checking membership:", err)
+			return "", fiber.NewError(fiber.StatusInternalServerError, "Failed to check membership")
+		}
+		if !isMember {
+			return "", fiber.NewError(fiber.StatusForbidden, "Not a member of the channel")
+		}
+
+		return channel.ChannelRoom(receiverID), nil
+
+	case "user":
+		if _, err := suser.GetByID(ctx, receiverID); err != nil {
+			if err == sql.ErrNoRows {
+				return "", fiber.NewError(fiber.StatusNotFound, "User not found")
+			}
+			log.Println("Failed to retrieve user:", err)
+			return "", fiber.NewError(fiber.StatusInternalServerError, "Failed to retrieve user")
+		}
+
+		return channel.DirectRoom(userID, receiverID), nil
+
+	default:
+		return "", fiber.NewError(fiber.StatusBadRequest, "Invalid or missing receiver_class. Must be 'user' or 'channel'.")
+	}
+}
+
+// session is the state of one chat socket shared by the event handlers.
+type session struct {
+	client        *hub.Client
+	userID        int64
+	receiverID    int64
+	receiverClass string
+	room          string
+	typing        map[string]time.Time
+	expiry        *time.Timer
+	idle          *time.Timer
+	handlers      map[string]handler
+	hub           *hub.Hub
+
+	// Flood control, only touched by the read loop
+	bucket     *ratelimit.Bucket
+	violations []time.Time
+	mutedUntil time.Time
+}
+
+var (
+	// limits are the flood limits of sockets, set by Limit
+	limits ratelimit.Config
+
+	// userLimiter caps the frames of a user across all of their sockets
+	userLimiter *ratelimit.Limiter
+)
+
+// Limit sets the flood limits of sockets. It is called at startup, before
+// any socket is served.
+func Limit(config ratelimit.Config) {
+	limits = config
+	userLimiter = ratelimit.NewLimiter(config.UserRate, config.UserBurst)
+}
+
+type handler func(s *session, env *event.Envelope) error
+
+// chatHandlers dispatches chat socket frames by envelope type.
+var chatHandlers = map[string]handler{
+	event.TypeMessageSend: sendMessage,
+	event.TypeMessageEdit: editMessage,
+	event.TypeRead:        markRead,
+	event.TypeTypingStart: startTyping,
+	event.TypeTypingStop:  stopTyping,
+	event.TypePresence:    heartbeat,
+	event.TypeAuth:        authenticate,
+	event.TypeError:       clientError,
+}
+
+// multiplexHandlers dispatches multiplexed socket frames by envelope type.
+var multiplexHandlers = map[string]handler{
+	event.TypeMessageSend: sendMessage,
+	event.TypeMessageEdit: editMessage,
+	event.TypeRead:        markRead,
+	event.TypeTypingStart: startTyping,
+	event.TypeTypingStop:  stopTyping,
+	event.TypePresence:    heartbeat,
+	event.TypeAuth:        authenticate,
+	event.TypeError:       clientError,
+	event.TypeSubscribe:   subscribe,
+	event.TypeUnsubscribe: unsubscribe,
+}
+
+// notificationHandlers dispatches notification socket frames by envelope type.
+var notificationHandlers = map[string]handler{
+	event.TypeAuth:  authenticate,
+	event.TypeError: clientError,
+}
+
+// eventError is returned by handlers to answer the sender with an error event.
+type eventError struct {
+	payload event.Error
+}
+
+func (e *eventError) Error() string {
+	return e.payload.Message
+}
+
+func newEventError(code, message string, details interface{}) *eventError {
+	return &eventError{payload: event.Error{Code: code, Message: message, Details: details}}
+}
+
+func Chat(c *websocket.Conn) {
+	sessions.add()
+	defer sessions.done()
+
+	s := new(session)
+	s.room, _ = c.Locals("room").(string)
+	s.userID, _ = c.Locals("user_id").(int64)
+	s.receiverID, _ = c.Locals("receiver_id").(int64)
+	s.receiverClass, _ = c.Locals("receiver_class").(string)
+	s.handlers = chatHandlers
+	s.hub = channel.ChatHub
+	s.typing = make(map[string]time.Time)
+
+	since, replay := c.Locals("since").(int64)
+
+	if replay {
+		s.client = channel.ChatHub.RegisterHeld(hub.WebSocket(c), s.userID, s.room)
+	} else {
+		s.client = channel.ChatHub.Register(hub.WebSocket(c), s.userID, s.room)
+	}
+	defer channel.ChatHub.Unregister(s.client)
+
+	if replay {
+		if err := s.replay(since); err != nil {
+			if err != errClosed {
+				log.Print(err)
+				s.client.Close(websocket.CloseInternalServerErr, "replay failed")
+			}
+			return
+		}
+	}
+
+	// A socket that goes away stops typing
+	defer s.endAllTyping()
+
+	s.idle = time.AfterFunc(settings.WebSocketIdleTimeout, func() {
+		s.client.Close(hub.CloseIdleTimeout, "idle timeout")
+	})
+	defer s.idle.Stop()
+
+	s.serve(c)
+}
+
+// Multiplex serves a single socket for many conversations of the user. It
+// opens without rooms: subscribe and unsubscribe events pick the rooms it
+// receives, and channels the user is added to meanwhile join automatically.
+func Multiplex(c *websocket.Conn) {
+	sessions.add()
+	defer sessions.done()
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+
+	s := new(session)
+	s.userID = int64(sub)
+	s.handlers = multiplexHandlers
+	s.hub = channel.ChatHub
+	s.typing = make(map[string]time.Time)
+
+	s.client = channel.ChatHub.Register(hub.WebSocket(c), s.userID, "")
+	defer channel.ChatHub.Unregister(s.client)
+
+	defer s.endAllTyping()
+
+	s.idle = time.AfterFunc(settings.WebSocketIdleTimeout, func() {
+		s.client.Close(hub.CloseIdleTimeout, "idle timeout")
+	})
+	defer s.idle.Stop()
+
+	s.serve(c)
+}
+
+// Notifications streams the notifications of the authenticated user. The
+// socket is keyed by the token subject and is not bound to a room.
+func Notifications(c *websocket.Conn) {
+	sessions.add()
+	defer sessions.done()
+
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	sub, _ := claims["sub"].(float64)
+
+	s := new(session)
+	s.userID = int64(sub)
+	s.handlers = notificationHandlers
+	s.hub = channel.NotificationHub
+
+	s.client = channel.NotificationHub.Register(hub.WebSocket(c), s.userID, "")
+	defer channel.NotificationHub.Unregister(s.client)
+
+	s.serve(c)
+}
+
+// serve reads and dispatches frames until the connection fails.
+func (s *session) serve(c *websocket.Conn) {
+	// Close the socket when its access token expires, unless the client
+	// authenticates again in-band
+	claims, _ := c.Locals("claims").(jwtv4.MapClaims)
+	s.expiry = time.AfterFunc(time.Until(expiresAt(claims)), func() {
+		s.client.Close(hub.CloseTokenExpired, "token expired")
+	})
+	defer s.expiry.Stop()
+
+	// Frames far above the size limit close the socket outright, smaller
+	// oversized frames are answered with an error event
+	s.bucket = ratelimit.NewBucket(limits.Rate, limits.Burst)
+	c.SetReadLimit(limits.MaxFrameSize * 4)
+
+	// Dead peers are noticed when no pong arrives in time
+	_ = c.SetReadDeadline(time.Now().Add(settings.WebSocketPongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(settings.WebSocketPongWait))
+	})
+
+	for {
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		_ = c.SetReadDeadline(time.Now().Add(settings.WebSocketPongWait))
+
+		if s.idle != nil {
+			s.idle.Reset(settings.WebSocketIdleTimeout)
+		}
+
+		if !s.admit(p) {
+			continue
+		}
+
+		s.dispatch(p)
+	}
+}
+
+// admit applies the flood limits to a frame and reports whether it may be
+// dispatched. Violations are answered with an error event; a connection that
+// collects too many is muted and its frames are dropped until the mute ends.
+func (s *session) admit(p []byte) bool {
+	now := time.Now()
+
+	if now.Before(s.mutedUntil) {
+		return false
+	}
+
+	switch {
+	case int64(len(p)) > limits.MaxFrameSize:
+		s.hub.Count(hub.ViolationSize)
+		s.fail(nil, newEventError(event.ErrorTooLarge, "Frame exceeds the size limit", fiber.Map{"max_size": limits.MaxFrameSize}))
+	case !s.bucket.Allow() || !userLimiter.Allow(s.userID):
+		s.hub.Count(hub.ViolationRate)
+		s.fail(nil, newEventError(event.ErrorRateLimited, "Too many events", nil))
+	default:
+		return true
+	}
+
+	// Only violations within the window count towards a mute
+	recent := s.violations[:0]
+	for _, at := range s.violations {
+		if now.Sub(at) < limits.ViolationWindow {
+			recent = append(recent, at)
+		}
+	}
+	s.violations = append(recent, now)
+
+	if len(s.violations) >= limits.MaxViolations {
+		s.violations = nil
+		s.mutedUntil = now.Add(limits.MuteDuration)
+
+		s.hub.Count(hub.ViolationMute)
+		s.fail(nil, newEventError(event.ErrorMuted, "Muted for sending too many events", fiber.Map{"until": s.mutedUntil.UTC()}))
+	}
+
+	return false
+}
+
+// errClosed is returned by replay when the client went away meanwhile.
+var errClosed = errors.New("ws: client closed during replay")
+
+// replay streams the stored messages after since, then releases the live
+// events held since registration. Live messages that were already replayed
+// are dropped, so the handover has neither gaps nor duplicates: messages
+// reach a room in id order, so none after since is stored later.
+func (s *session) replay(since int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	var (
+		messages []mmsg.Message
+		err      error
+	)
+
+	filter := map[string][]string{}
+	args := []interface{}{}
+
+	switch s.receiverClass {
+	case "user":
+		filter["and"] = []string{
+			"((dm.sender_id = ? AND dm.receiver_id = ?) OR (dm.sender_id = ? AND dm.receiver_id = ?))",
+			"dm.id > ?",
+		}
+		args = append(args, s.userID, s.receiverID, s.receiverID, s.userID, since)
+
+		messages, err = smsg.FetchDirectMessages(ctx, s.userID, s.receiverID, filter, args, "dm.id", "ASC", settings.WebSocketReplayLimit, 0)
+
+	case "channel":
+		filter["and"] = []string{"chm.id > ?"}
+		args = append(args, since)
+
+		messages, err = smsg.FetchChannelMessages(ctx, s.userID, s.receiverID, filter, args, "chm.id", "ASC", settings.WebSocketReplayLimit, 0)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	lastID := since
+	frames := make([][]byte, 0, len(messages)+1)
+
+	// Live messages stored before the query are held as well
+	replayed := make(map[int64]bool, len(messages))
+
+	for i := range messages {
+		p, err := event.New(event.TypeMessageCreated, s.room, &messages[i])
+		if err != nil {
+			return err
+		}
+
+		frames = append(frames, p)
+		lastID = messages[i].ID
+		replayed[lastID] = true
+	}
+
+	// A truncated replay tells the client to page the rest over REST
+	p, err := event.New(event.TypeReplayCompleted, s.room, fiber.Map{
+		"last_id":   lastID,
+		"truncated": len(messages) == settings.WebSocketReplayLimit,
+	})
+	if err != nil {
+		return err
+	}
+
+	frames = append(frames, p)
+
+	ok := s.client.Resume(frames, func(p []byte) bool {
+		env := new(event.Envelope)
+		if err := json.Unmarshal(p, env); err != nil || env.Type != event.TypeMessageCreated {
+			return false
+		}
+
+		msg := new(mmsg.Message)
+		if err := json.Unmarshal(env.Payload, msg); err != nil {
+			return false
+		}
+
+		return replayed[msg.ID]
+	})
+	if !ok {
+		return errClosed
+	}
+
+	return nil
+}
+
+// expiresAt returns the expiration of a token, defaulting to a fresh access
+// token lifetime when the claim is missing.
+func expiresAt(claims jwtv4.MapClaims) time.Time {
+	if exp, ok := claims["exp"].(float64); ok {
+		return time.Unix(int64(exp), 0)
+	}
+
+	return time.Now().Add(settings.ShortExpiration)
+}
+
+func (s *session) dispatch(p []byte) {
+	env, err := event.Parse(p)
+	if err != nil {
+		switch err {
+		case event.ErrVersionMismatch:
+			s.fail(env, newEventError(event.ErrorUnsupportedVersion, "Unsupported envelope version", fiber.Map{"supported": event.Version}))
+		case event.ErrMissingType:
+			s.fail(env, newEventError(event.ErrorMalformed, "Missing event type", nil))
+		default:
+			s.fail(nil, newEventError(event.ErrorMalformed, "Frame is not a valid event envelope", nil))
+		}
+		return
+	}
+
+	// Any frame but an explicit presence update counts as activity
+	if env.Type != event.TypePresence {
+		channel.ChatPresence.Heartbeat(s.userID, s.client, false)
+	}
+
+	handle, ok := s.handlers[env.Type]
+	if !ok {
+		s.fail(env, newEventError(event.ErrorUnsupportedType, "Unsupported event type", fiber.Map{"type": env.Type}))
+		return
+	}
+
+	if err := handle(s, env); err != nil {
+		if e, ok := err.(*eventError); ok {
+			s.fail(env, e)
+			return
+		}
+
+		log.Print(err)
+		s.fail(env, newEventError(event.ErrorInternal, "Failed to handle event", nil))
+	}
+}
+
+// conversation is the room an event is about and the receiver it stands for.
+type conversation struct {
+	room          string
+	receiverID    int64
+	receiverClass string
+}
+
+// conversation returns the conversation of env. The room defaults to the one
+// the socket was opened for, and any other room must be subscribed.
+func (s *session) conversation(env *event.Envelope) (*conversation, error) {
+	room := env.Room
+	if room == "" {
+		room = s.room
+	}
+
+	if room == "" {
+		return nil, newEventError(event.ErrorInvalid, "Missing room", nil)
+	}
+
+	if room != s.room && !s.hub.Subscribed(s.client, room) {
+		return nil, newEventError(event.ErrorForbidden, "Not subscribed to room", fiber.Map{"room": room})
+	}
+
+	class, ids, ok := channel.ParseRoom(room)
+	if !ok {
+		return nil, newEventError(event.ErrorInvalid, "Invalid room", fiber.Map{"room": room})
+	}
+
+	conv := &conversation{room: room, receiverID: ids[0], receiverClass: class}
+
+	// A direct room holds both users, the receiver is the other one
+	if class == "user" && ids[0] == s.userID {
+		conv.receiverID = ids[1]
+	}
+
+	return conv, nil
+}
+
+// reply queues an event for this socket alone, tagged with the room of env
+// and echoing its correlation ids when there is one.
+func (s *session) reply(env *event.Envelope, typ string, payload interface{}) {
+	room := s.room
+
+	var clientID, ackID string
+	if env != nil {
+		clientID, ackID = env.ClientID, env.AckID
+
+		if env.Room != "" {
+			room = env.Room
+		}
+	}
+
+	p, err := event.Reply(typ, room, payload, clientID, ackID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	s.client.Send(p)
+}
+
+func (s *session) fail(env *event.Envelope, e *eventError) {
+	s.reply(env, event.TypeError, e.payload)
+}
+
+func sendMessage(s *session, env *event.Envelope) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	conv, err := s.conversation(env)
+	if err != nil {
+		return err
+	}
+
+	msg := new(mmsg.Message)
+	if err := env.Decode(msg); err != nil {
+		return newEventError(event.ErrorMalformed, "Invalid message payload", nil)
+	}
+
+	// The room decides the sender and receiver, not the payload
+	msg.Sender = mmsg.User{ID: s.userID}
+	msg.ReceiverID = &conv.receiverID
+	msg.ReceiverClass = conv.receiverClass
+
+	if invalid := validate.All(msg); len(invalid) > 0 {
+		return newEventError(event.ErrorInvalid, "Invalid message", invalid)
+	}
+
+	result, err := smsg.Send(ctx, msg, env.ClientID)
+	if err != nil {
+		switch err {
+		case smsg.ErrEmpty:
+			return newEventError(event.ErrorInvalid, "A message needs text or attachment_ids", nil)
+		case smsg.ErrInvalidParent:
+			return newEventError(event.ErrorInvalid, "Invalid parent_id", nil)
+		case smsg.ErrInvalidAttachment:
+			return newEventError(event.ErrorInvalid, "Invalid attachment_ids", nil)
+		}
+
+		return err
+	}
+
+	if env.AckID != "" {
+		s.reply(env, event.TypeAck, fiber.Map{"id": result.ID, "sent_at": result.SentAt})
+	}
+
+	return nil
+}
+
+// editMessage edits a message of the user in the room of env.
+func editMessage(s *session, env *event.Envelope) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	conv, err := s.conversation(env)
+	if err != nil {
+		return err
+	}
+
+	payload := struct {
+		ID      int64  `json:"id"`
+		Message string `json:"message"`
+	}{}
+
+	if err := env.Decode(&payload); err != nil {
+		return newEventError(event.ErrorMalformed, "Invalid edit payload", nil)
+	}
+
+	if payload.ID == 0 || strings.TrimSpace(payload.Message) == "" {
+		return newEventError(event.ErrorInvalid, "Message id and text are required", nil)
+	}
+
+	result, err := smsg.Edit(ctx, payload.ID, conv.receiverClass, s.userID, payload.Message, env.ClientID)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return newEventError(event.ErrorInvalid, "Message not found", nil)
+		case smsg.ErrNotSender:
+			return newEventError(event.ErrorForbidden, "Only the sender may edit a message", nil)
+		case smsg.ErrNotMember:
+			return newEventError(event.ErrorForbidden, "Not a member of the channel", nil)
+		case smsg.ErrEditWindow:
+			return newEventError(event.ErrorForbidden, "Edit window has passed", fiber.Map{"window": settings.MessageEditWindow.String()})
+		}
+
+		return err
+	}
+
+	if env.AckID != "" {
+		s.reply(env, event.TypeAck, fiber.Map{"id": result.ID, "edited_at": result.EditedAt})
+	}
+
+	return nil
+}
+
+// markRead moves the read position of the user in the room of env up to a
+// message, or to the latest message when none is given.
+func markRead(s *session, env *event.Envelope) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	conv, err := s.conversation(env)
+	if err != nil {
+		return err
+	}
+
+	payload := new(mmsg.ReadPayload)
+	if len(env.Payload) > 0 {
+		if err := env.Decode(payload); err != nil {
+			return newEventError(event.ErrorMalformed, "Invalid read payload", nil)
+		}
+	}
+
+	lastReadID, err := smsg.MarkRead(ctx, s.userID, conv.receiverClass, conv.receiverID, payload.MessageID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return newEventError(event.ErrorInvalid, "Message not found", nil)
+		}
+
+		return err
+	}
+
+	if env.AckID != "" {
+		s.reply(env, event.TypeAck, fiber.Map{"last_read_id": lastReadID})
+	}
+
+	return nil
+}
+
+// clientError records errors reported by the client; they are never relayed.
+func clientError(s *session, env *event.Envelope) error {
+	log.Printf("client error from user %d in %s: %s", s.userID, s.room, env.Payload)
+
+	return nil
+}
+
+// Typing relays a typing event of userID to every other connection in room.
+// Typing events are never stored.
+func Typing(room string, userID int64, typ string) {
+	p, err := event.New(typ, room, fiber.Map{"user_id": userID})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if err := channel.ChatHub.BroadcastExcept(room, p, userID); err != nil {
+		log.Print(err)
+	}
+}
+
+// startTyping refreshes the typing state on every frame but relays repeated
+// typing.start frames at most once every settings.TypingThrottle.
+func startTyping(s *session, env *event.Envelope) error {
+	conv, err := s.conversation(env)
+	if err != nil {
+		return err
+	}
+
+	started := channel.ChatTyping.Start(conv.room, s.userID)
+
+	if !started && time.Since(s.typing[conv.room]) < settings.TypingThrottle {
+		return nil
+	}
+
+	s.typing[conv.room] = time.Now()
+
+	Typing(conv.room, s.userID, event.TypeTypingStart)
+
+	return nil
+}
+
+func stopTyping(s *session, env *event.Envelope) error {
+	conv, err := s.conversation(env)
+	if err != nil {
+		return err
+	}
+
+	s.endTyping(conv.room)
+
+	return nil
+}
+
+// endTyping relays typing.stop to room if the user is typing there.
+func (s *session) endTyping(room string) {
+	delete(s.typing, room)
+
+	if channel.ChatTyping.Stop(room, s.userID) {
+		Typing(room, s.userID, event.TypeTypingStop)
+	}
+}
+
+func (s *session) endAllTyping() {
+	for room := range s.typing {
+		s.endTyping(room)
+	}
+}
+
+// subscribe adds a conversation to a multiplexed socket once the membership
+// of the user is checked.
+func subscribe(s *session, env *event.Envelope) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	payload := struct {
+		ID            int64  `json:"id"`
+		ReceiverClass string `json:"receiver_class"`
+	}{}
+
+	if err := env.Decode(&payload); err != nil {
+		return newEventError(event.ErrorMalformed, "Invalid subscribe payload", nil)
+	}
+
+	if s.hub.Subscriptions(s.client) >= settings.WebSocketSubscriptionLimit {
+		return newEventError(event.ErrorInvalid, "Too many subscriptions", fiber.Map{"max": settings.WebSocketSubscriptionLimit})
+	}
+
+	room, err := resolve(ctx, s.userID, payload.ID, strings.ToLower(payload.ReceiverClass))
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			switch e.Code {
+			case fiber.StatusForbidden:
+				return newEventError(event.ErrorForbidden, e.Message, nil)
+			case fiber.StatusBadRequest, fiber.StatusNotFound:
+				return newEventError(event.ErrorInvalid, e.Message, nil)
+			}
+		}
+
+		return err
+	}
+
+	s.hub.Subscribe(s.client, room)
+
+	// The ack is tagged with the room it subscribed
+	env.Room = room
+
+	s.reply(env, event.TypeAck, fiber.Map{"room": room})
+
+	return nil
+}
+
+// unsubscribe removes the room of env from a multiplexed socket.
+func unsubscribe(s *session, env *event.Envelope) error {
+	if env.Room == "" {
+		return newEventError(event.ErrorInvalid, "Missing room", nil)
+	}
+
+	s.endTyping(env.Room)
+
+	s.hub.Unsubscribe(s.client, env.Room)
+
+	s.reply(env, event.TypeAck, fiber.Map{"room": env.Room})
+
+	return nil
+}
+
+// Presence stores the last seen time of a user going offline and pushes
+// presence.changed to everyone sharing a channel or a DM with the user, on
+// every node. The tracker calls it on a single node for each change.
+func Presence(p *presence.Presence) {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	if p.Status == presence.StatusOffline && p.LastSeenAt != nil {
+		if err := suser.UpdateLastSeen(ctx, p.UserID, *p.LastSeenAt); err != nil {
+			log.Print(err)
+		}
+	}
+
+	ids, err := contacts.get(ctx, p.UserID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	msg, err := event.New(event.TypePresenceChanged, "", p)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if err := channel.ChatHub.BroadcastUsers(ids, msg); err != nil {
+		log.Print(err)
+	}
+}
+
+// heartbeat handles presence frames, which report whether the client is
+// active or idle.
+func heartbeat(s *session, env *event.Envelope) error {
+	payload := struct {
+		Status string `json:"status"`
+	}{Status: presence.StatusOnline}
+
+	if len(env.Payload) > 0 {
+		if err := env.Decode(&payload); err != nil {
+			return newEventError(event.ErrorMalformed, "Invalid presence payload", nil)
+		}
+	}
+
+	switch payload.Status {
+	case presence.StatusOnline, presence.StatusIdle:
+	default:
+		return newEventError(event.ErrorInvalid, "Status must be 'online' or 'idle'", nil)
+	}
+
+	channel.ChatPresence.Heartbeat(s.userID, s.client, payload.Status == presence.StatusIdle)
+
+	return nil
+}
+
+// authenticate extends the lifetime of the socket with a fresh access token
+// of the same user.
+func authenticate(s *session, env *event.Envelope) error {
+	payload := struct {
+		Token string `json:"token"`
+	}{}
+
+	if err := env.Decode(&payload); err != nil {
+		return newEventError(event.ErrorMalformed, "Invalid auth payload", nil)
+	}
+
+	claims, err := jwt.ParseToken(payload.Token, os.Getenv("JWT_ACCESS_TOKEN_KEY"))
+	if err != nil {
+		return newEventError(event.ErrorUnauthorized, "Invalid access token", nil)
+	}
+
+	if sub, _ := claims["sub"].(float64); int64(sub) != s.userID {
+		return newEventError(event.ErrorForbidden, "Access token belongs to another user", nil)
+	}
+
+	exp := expiresAt(claims)
+
+	s.expiry.Reset(time.Until(exp))
+
+	s.reply(env, event.TypeAck, fiber.Map{"expires_at": exp})
+
+	return nil
+}
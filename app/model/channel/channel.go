@@ -48,4 +48,7 @@ type ChannelWithMessage struct {
 	MessageID *int64     `json:"message_id,omitempty"`
 	Message   *string    `json:"message,omitempty"`
 	SentAt    *time.Time `json:"sent_at,omitempty"`
+
+	UnreadCount int64  `json:"unread_count"`
+	LastReadID  *int64 `json:"last_read_id"`
 }
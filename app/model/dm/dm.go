@@ -8,4 +8,9 @@ type DMListItem struct {
 	ReceiverID int64     `json:"receiver_id"`
 	Message    string    `json:"message"`
 	SentAt     time.Time `json:"sent_at"`
+
+	UnreadCount int64  `json:"unread_count"`
+	LastReadID  *int64 `json:"last_read_id"`
+	// Read position of the other user, for "seen" markers
+	CounterpartLastReadID *int64 `json:"counterpart_last_read_id"`
 }
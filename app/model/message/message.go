@@ -11,16 +11,62 @@ type User struct {
 }
 
 type Message struct {
-	ID            int64      `json:"id,omitempty"`
-	Message       string     `json:"message"`
-	SentAt        time.Time  `json:"sent_at"`
-	IsEdited      bool       `json:"is_edited"`
-	EditedAt      *time.Time `json:"edited_at,omitempty"`
-	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
-	Sender        User       `json:"sender"`
-	Receiver      *User      `json:"receiver,omitempty"`
-	ReceiverID    *int64     `json:"receiver_id"`
-	ReceiverClass string     `json:"receiver_class"`
+	ID            int64        `json:"id,omitempty"`
+	Message       string       `json:"message"`
+	SentAt        time.Time    `json:"sent_at"`
+	IsEdited      bool         `json:"is_edited"`
+	EditedAt      *time.Time   `json:"edited_at,omitempty"`
+	DeletedAt     *time.Time   `json:"deleted_at,omitempty"`
+	DeletedBy     *int64       `json:"deleted_by,omitempty"`
+	Sender        User         `json:"sender"`
+	Receiver      *User        `json:"receiver,omitempty"`
+	ReceiverID    *int64       `json:"receiver_id" validate:"required"`
+	ReceiverClass string       `json:"receiver_class" validate:"required"`
+	ParentID      *int64       `json:"parent_id,omitempty"`
+	Thread        *Thread      `json:"thread,omitempty"`
+	Reactions     []Reaction   `json:"reactions,omitempty"`
+	AttachmentIDs []int64      `json:"attachment_ids,omitempty"`
+	Attachments   []Attachment `json:"attachments,omitempty"`
+}
+
+// Reaction is the number of users who reacted to a message with Emoji.
+type Reaction struct {
+	Emoji       string `json:"emoji"`
+	Count       int64  `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me"`
+}
+
+type ReactionPayload struct {
+	Emoji         string `json:"emoji" validate:"required"`
+	ReceiverClass string `json:"receiver_class" validate:"required"`
+}
+
+// Thread summarizes the replies to a message. Deleted replies are not
+// counted.
+type Thread struct {
+	ParentID     int64      `json:"parent_id"`
+	ReplyCount   int64      `json:"reply_count"`
+	LastReplyAt  *time.Time `json:"last_reply_at,omitempty"`
+	Participants []int64    `json:"participants"`
+}
+
+type EditPayload struct {
+	Message       string `json:"message" validate:"required"`
+	ReceiverClass string `json:"receiver_class" validate:"required"`
+}
+
+// Edit is a prior version of a message, replaced at EditedAt.
+type Edit struct {
+	ID        int64     `json:"id"`
+	MessageID int64     `json:"message_id"`
+	Message   string    `json:"message"`
+	EditedBy  int64     `json:"edited_by"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+type ReadPayload struct {
+	// Defaults to the latest message of the conversation
+	MessageID int64 `json:"message_id"`
 }
 
 type Query struct {
@@ -37,3 +83,53 @@ type Query struct {
 		Lte *time.Time `json:"lte,omitempty" query:"lte"`
 	} `json:"created,omitempty" query:"created"`
 }
+
+// Cursor is a position in a message history, which is ordered by
+// (SentAt, ID). Direction tells whether the page it opens holds the messages
+// before or after that position.
+type Cursor struct {
+	Direction string    `json:"d"`
+	SentAt    time.Time `json:"t"`
+	ID        int64     `json:"id"`
+}
+
+// Attachment describes a file uploaded to be sent with a message. It is
+// downloaded from GET /api/v1/file/:id.
+type Attachment struct {
+	ID          int64     `json:"id"`
+	OwnerID     int64     `json:"owner_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// Set for images once their preview is made
+	Width         *int    `json:"width,omitempty"`
+	Height        *int    `json:"height,omitempty"`
+	DominantColor *string `json:"dominant_color,omitempty"`
+
+	// pending, processing, ready or failed; unset for files without previews
+	PreviewStatus *string `json:"preview_status,omitempty"`
+
+	// Sizes that may be downloaded with ?size=
+	Previews []string `json:"previews,omitempty"`
+
+	// Object key of the stored file
+	Key string `json:"-"`
+
+	// Message the file was sent with, unset until then
+	ReceiverClass *string `json:"-"`
+	MessageID     *int64  `json:"-"`
+}
+
+// AttachmentVariant is a preview of an image attachment, named after one of
+// settings.ThumbnailSizes.
+type AttachmentVariant struct {
+	Name        string
+	Key         string
+	ContentType string
+	Width       int
+	Height      int
+	Size        int64
+}
@@ -0,0 +1,26 @@
+package model
+
+// Membership actions
+const (
+	ActionJoined string = "joined"
+
+	ActionLeft string = "left"
+
+	ActionDeleted string = "deleted"
+)
+
+type Invite struct {
+	ChannelID int64  `json:"channel_id"`
+	Name      string `json:"name"`
+	InvitedBy int64  `json:"invited_by"`
+}
+
+type Membership struct {
+	ChannelID int64  `json:"channel_id"`
+	UserID    int64  `json:"user_id"`
+	Action    string `json:"action"`
+}
+
+type System struct {
+	Message string `json:"message"`
+}
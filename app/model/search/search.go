@@ -0,0 +1,32 @@
+package model
+
+import (
+	"time"
+
+	mmsg "chatbox/app/model/message"
+)
+
+// Query is a parsed search. Text keeps the words and quoted phrases, the
+// operators are taken out of it.
+type Query struct {
+	Text          string
+	From          []string
+	Channels      []string
+	Users         []string
+	Before        *time.Time
+	After         *time.Time
+	HasAttachment bool
+}
+
+// Result is a message that matched a search. Snippet is the matching part of
+// the message, HTML-escaped, with the matched words wrapped in <mark> tags.
+type Result struct {
+	ID            int64     `json:"id"`
+	ReceiverClass string    `json:"receiver_class"`
+	ReceiverID    int64     `json:"receiver_id"`
+	ParentID      *int64    `json:"parent_id,omitempty"`
+	Sender        mmsg.User `json:"sender"`
+	SentAt        time.Time `json:"sent_at"`
+	Snippet       string    `json:"snippet"`
+	Rank          float64   `json:"rank"`
+}
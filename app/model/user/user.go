@@ -11,6 +11,8 @@ type User struct {
 	Password     string     `json:"hashed_password,omitempty"`
 	IsActive     *bool      `json:"is_active,omitempty"`
 	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	Status       string     `json:"status,omitempty"`
+	LastSeenAt   *time.Time `json:"last_seen_at,omitempty"`
 }
 
 type Query struct {
@@ -34,4 +36,6 @@ type UserDetails struct {
 	Username     string     `json:"username,omitempty"`
 	IsActive     *bool      `json:"is_active,omitempty"`
 	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	Status       string     `json:"status,omitempty"`
+	LastSeenAt   *time.Time `json:"last_seen_at,omitempty"`
 }
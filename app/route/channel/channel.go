@@ -14,5 +14,6 @@ func Route(router fiber.Router) {
 	router.Get("/channel/:id", hjwt.ValidateAccessToken, cchannel.GetChannelDetailsByID)
 	router.Post("/channel/add_member", hjwt.ValidateAccessToken, cchannel.AddMemberToChannel)
 	router.Delete("/channel/:id", hjwt.ValidateAccessToken, cchannel.DeleteChannel)
+	router.Post("/channel/:id/read", hjwt.ValidateAccessToken, cchannel.MarkChannelRead)
 	router.Put("/channel/leave", hjwt.ValidateAccessToken, cchannel.LeaveChannel)
 }
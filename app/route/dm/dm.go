@@ -10,4 +10,5 @@ import (
 
 func Route(router fiber.Router) {
 	router.Get("/direct-messages", hjwt.ValidateAccessToken, cdm.GetUserDMList)
+	router.Post("/direct-messages/:id/read", hjwt.ValidateAccessToken, cdm.MarkDMRead)
 }
@@ -3,12 +3,14 @@ package route
 import (
 	"github.com/gofiber/fiber/v2"
 
+	cattachment "chatbox/app/controller/attachment"
+
 	hfile "chatbox/pkg/handler/file"
 	hjwt "chatbox/pkg/handler/jwt"
 )
 
 func Route(router fiber.Router) {
-	router.Post("/file", hjwt.ValidateAccessToken, hfile.Upload)
+	router.Post("/file", hjwt.ValidateAccessToken, cattachment.Reserve, hfile.Upload, cattachment.Upload)
 
-	router.Get("/file/:filename", hjwt.ValidateAccessToken, hfile.Download)
+	router.Get("/file/:id", hjwt.ValidateAccessToken, cattachment.Authorize, hfile.Download)
 }
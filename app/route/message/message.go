@@ -11,4 +11,10 @@ import (
 func Route(router fiber.Router) {
 	router.Get("/message", hjwt.ValidateAccessToken, cmsg.GetMessages)
 	router.Post("/message", hjwt.ValidateAccessToken, cmsg.SendMessage)
+	router.Patch("/message/:id", hjwt.ValidateAccessToken, cmsg.EditMessage)
+	router.Delete("/message/:id", hjwt.ValidateAccessToken, cmsg.DeleteMessage)
+	router.Post("/message/:id/reactions", hjwt.ValidateAccessToken, cmsg.AddReaction)
+	router.Delete("/message/:id/reactions", hjwt.ValidateAccessToken, cmsg.RemoveReaction)
+	router.Get("/message/:id/thread", hjwt.ValidateAccessToken, cmsg.GetThread)
+	router.Get("/message/:id/history", hjwt.ValidateAccessToken, cmsg.GetEditHistory)
 }
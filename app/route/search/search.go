@@ -0,0 +1,13 @@
+package route
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	csearch "chatbox/app/controller/search"
+
+	hjwt "chatbox/pkg/handler/jwt"
+)
+
+func Route(router fiber.Router) {
+	router.Get("/search/messages", hjwt.ValidateAccessToken, csearch.SearchMessages)
+}
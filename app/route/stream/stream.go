@@ -0,0 +1,14 @@
+package route
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	cws "chatbox/app/controller/ws"
+
+	hdrain "chatbox/pkg/handler/drain"
+	hjwt "chatbox/pkg/handler/jwt"
+)
+
+func Route(router fiber.Router) {
+	router.Get("/stream/chat/:id", hdrain.Streams, hjwt.ValidateAccessToken, cws.Authorize, cws.ChatStream)
+}
@@ -20,6 +20,8 @@ func Route(router fiber.Router) {
 
 	router.Get("/users", hjwt.ValidateAccessToken, cuser.GetUsers)
 
+	router.Get("/users/presence", hjwt.ValidateAccessToken, cuser.GetPresence)
+
 	router.Get("/user/profile", hjwt.ValidateAccessToken, cuser.GetCurrentUser)
 
 	router.Get("/user/:id", hjwt.ValidateAccessToken, cuser.GetUserDetails)
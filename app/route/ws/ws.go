@@ -0,0 +1,37 @@
+package route
+
+import (
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+
+	cws "chatbox/app/controller/ws"
+
+	"chatbox/pkg/channel/event"
+	hdrain "chatbox/pkg/handler/drain"
+	hjwt "chatbox/pkg/handler/jwt"
+)
+
+func Route(router fiber.Router) {
+	router.Use(func(c *fiber.Ctx) error {
+		if c.Query("v") == event.Version {
+			return c.Next()
+		}
+
+		return c.SendStatus(fiber.StatusNotFound)
+	})
+
+	router.Use(hdrain.Streams)
+
+	router.Use(func(c *fiber.Ctx) error {
+		if websocket.IsWebSocketUpgrade(c) {
+			return c.Next()
+		}
+		return fiber.ErrUpgradeRequired
+	})
+
+	router.Get("/chat/:id", hjwt.ValidateAccessToken, cws.Authorize, websocket.New(cws.Chat))
+
+	router.Get("/v1", hjwt.ValidateAccessToken, websocket.New(cws.Multiplex))
+
+	router.Get("/notifications", hjwt.ValidateAccessToken, websocket.New(cws.Notifications))
+}
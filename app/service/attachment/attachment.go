@@ -0,0 +1,193 @@
+package service
+
+import (
+	"chatbox/pkg/database"
+	"chatbox/pkg/media"
+	"chatbox/pkg/settings"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+
+	mmsg "chatbox/app/model/message"
+)
+
+var ErrQuotaExceeded = errors.New("attachment: storage quota exceeded")
+
+// Reserve holds size bytes of the quota of ownerID for an upload before it is
+// stored, and returns the id of the reservation. Create consumes it; Release
+// gives it back when the upload is not recorded. It fails with
+// ErrQuotaExceeded when the files of the owner, their previews and the
+// uploads in progress would take more than settings.FileUserQuota.
+func Reserve(ctx context.Context, ownerID int64, size int64) (int64, error) {
+	tx, err := database.PostgresMain.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Concurrent uploads of the owner wait for each other's quota check
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('attachments'), $1)`, ownerID); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var used int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT
+			COALESCE((SELECT SUM(size) FROM attachments WHERE owner_id = $1), 0) +
+			COALESCE((
+				SELECT SUM(v.size) FROM attachment_variants v
+				JOIN attachments a ON a.id = v.attachment_id
+				WHERE a.owner_id = $1
+			), 0) +
+			COALESCE((SELECT SUM(size) FROM attachment_reservations WHERE owner_id = $1 AND expires_at > now()), 0)
+	`, ownerID).Scan(&used)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if used+size > settings.FileUserQuota {
+		tx.Rollback()
+		return 0, ErrQuotaExceeded
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO attachment_reservations (owner_id, size, expires_at)
+		VALUES ($1, $2, now() + make_interval(secs => $3))
+		RETURNING id
+	`, ownerID, size, settings.FileReservationTimeout.Seconds()).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Release gives back the quota of a reservation Create did not consume.
+func Release(ctx context.Context, reservation int64) error {
+	_, err := database.PostgresMain.DB.ExecContext(ctx, `
+		DELETE FROM attachment_reservations WHERE id = $1
+	`, reservation)
+
+	return err
+}
+
+// Create records a stored upload of a.OwnerID, not yet sent with a message,
+// in place of the reservation made for it by Reserve.
+func Create(ctx context.Context, a *mmsg.Attachment, reservation int64) (*mmsg.Attachment, error) {
+	tx, err := database.PostgresMain.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM attachment_reservations WHERE id = $1`, reservation); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// Images get previews, made by RunPreviews
+	if media.Previewable(a.ContentType) {
+		status := PreviewPending
+		a.PreviewStatus = &status
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO attachments (owner_id, object_key, filename, content_type, size, checksum, preview_status, preview_updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+		RETURNING id, created_at
+	`, a.OwnerID, a.Key, a.Filename, a.ContentType, a.Size, a.Checksum, a.PreviewStatus).Scan(&a.ID, &a.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Get returns an attachment with its object key and the message it was sent
+// with.
+func Get(ctx context.Context, id int64) (*mmsg.Attachment, error) {
+	a := new(mmsg.Attachment)
+
+	err := database.PostgresMain.DB.QueryRowContext(ctx, `
+		SELECT
+			id, owner_id, object_key, filename, content_type, size, checksum, created_at, receiver_class, message_id,
+			width, height, dominant_color, preview_status,
+			ARRAY(SELECT v.name FROM attachment_variants v WHERE v.attachment_id = attachments.id ORDER BY v.width)
+		FROM attachments
+		WHERE id = $1
+	`, id).Scan(
+		&a.ID, &a.OwnerID, &a.Key, &a.Filename, &a.ContentType, &a.Size, &a.Checksum, &a.CreatedAt, &a.ReceiverClass, &a.MessageID,
+		&a.Width, &a.Height, &a.DominantColor, &a.PreviewStatus,
+		pq.Array(&a.Previews),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Variant returns the preview of attachment id named name.
+func Variant(ctx context.Context, id int64, name string) (*mmsg.AttachmentVariant, error) {
+	v := new(mmsg.AttachmentVariant)
+
+	err := database.PostgresMain.DB.QueryRowContext(ctx, `
+		SELECT name, object_key, content_type, width, height, size
+		FROM attachment_variants
+		WHERE attachment_id = $1 AND name = $2
+	`, id, name).Scan(&v.Name, &v.Key, &v.ContentType, &v.Width, &v.Height, &v.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// CanRead reports whether userID may download a: the owner until it is sent,
+// then the members of the conversation it was sent in while the message is
+// not deleted.
+func CanRead(ctx context.Context, userID int64, a *mmsg.Attachment) (bool, error) {
+	if a.MessageID == nil || a.ReceiverClass == nil {
+		return a.OwnerID == userID, nil
+	}
+
+	var query string
+
+	switch *a.ReceiverClass {
+	case "user":
+		query = `
+			SELECT EXISTS (
+				SELECT 1 FROM direct_messages
+				WHERE id = $1 AND deleted_at IS NULL AND (sender_id = $2 OR receiver_id = $2)
+			)
+		`
+	case "channel":
+		query = `
+			SELECT EXISTS (
+				SELECT 1 FROM channel_messages chm
+				JOIN channel_members cm ON cm.channel_id = chm.channel_id AND cm.user_id = $2
+				WHERE chm.id = $1 AND chm.deleted_at IS NULL
+			)
+		`
+	default:
+		return false, fmt.Errorf("invalid receiver_class: %s", *a.ReceiverClass)
+	}
+
+	var ok bool
+	err := database.PostgresMain.DB.QueryRowContext(ctx, query, *a.MessageID, userID).Scan(&ok)
+
+	return ok, err
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"chatbox/pkg/database"
+	"chatbox/pkg/settings"
+	"chatbox/pkg/storage"
+	"context"
+	"log"
+	"time"
+)
+
+// RunCleanup deletes, every interval, the uploads not sent with a message
+// within settings.AttachmentUnsentTTL, then the stored objects of every
+// deleted attachment and preview. It returns once ctx is done.
+func RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := expire(ctx); err != nil {
+				log.Print(err)
+			}
+
+			if err := deleteObjects(ctx); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// expire deletes unsent uploads past their TTL and expired quota
+// reservations. The objects of the uploads, and those of their previews, are
+// queued in deleted_objects by trigger.
+func expire(stop context.Context) error {
+	ctx, cancel := context.WithTimeout(stop, settings.Timeout)
+	defer cancel()
+
+	_, err := database.PostgresMain.DB.ExecContext(ctx, `
+		DELETE FROM attachments
+		WHERE id IN (
+			SELECT id FROM attachments
+			WHERE message_id IS NULL AND created_at < now() - make_interval(secs => $1)
+			ORDER BY created_at
+			LIMIT $2
+		)
+	`, settings.AttachmentUnsentTTL.Seconds(), settings.AttachmentCleanupBatch)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.PostgresMain.DB.ExecContext(ctx, `
+		DELETE FROM attachment_reservations WHERE expires_at < now()
+	`)
+
+	return err
+}
+
+// deleteObjects removes queued objects from storage. Keys are claimed by
+// deleting them from the queue, and put back when the storage fails.
+func deleteObjects(stop context.Context) error {
+	ctx, cancel := context.WithTimeout(stop, settings.Timeout)
+	defer cancel()
+
+	rows, err := database.PostgresMain.DB.QueryContext(ctx, `
+		DELETE FROM deleted_objects
+		WHERE object_key IN (
+			SELECT object_key FROM deleted_objects
+			ORDER BY deleted_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING object_key
+	`, settings.AttachmentCleanupBatch)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{}
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// The keys are put back with a fresh context so a timeout loses none
+	for _, key := range keys {
+		if err := storage.Files.Delete(ctx, key); err != nil && err != storage.ErrNotFound {
+			log.Print(err)
+
+			_, err := database.PostgresMain.DB.ExecContext(context.Background(), `
+				INSERT INTO deleted_objects (object_key) VALUES ($1) ON CONFLICT DO NOTHING
+			`, key)
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"bytes"
+	"chatbox/pkg/channel"
+	"chatbox/pkg/channel/event"
+	"chatbox/pkg/database"
+	"chatbox/pkg/media"
+	"chatbox/pkg/settings"
+	"chatbox/pkg/storage"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	mmsg "chatbox/app/model/message"
+)
+
+// Preview statuses
+const (
+	PreviewPending string = "pending"
+
+	PreviewProcessing string = "processing"
+
+	PreviewReady string = "ready"
+
+	PreviewFailed string = "failed"
+)
+
+// ThumbnailSizes are the previews made of images, largest first, set at
+// startup from settings.ThumbnailSizes.
+var ThumbnailSizes []media.Size
+
+var previews = make(chan int64, settings.PreviewQueueSize)
+
+// Enqueue asks RunPreviews to make the previews of attachment id. It never
+// blocks; attachments left out of a full queue are found by the next sweep.
+func Enqueue(id int64) {
+	select {
+	case previews <- id:
+	default:
+	}
+}
+
+// RunPreviews makes the previews of enqueued attachments, and every interval
+// of pending attachments the queue missed. It returns once ctx is done and
+// the current job is finished; jobs left in the queue are swept by the next
+// run.
+func RunPreviews(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-previews:
+			preview(ctx, id)
+		case <-ticker.C:
+			sweep(ctx)
+		}
+	}
+}
+
+// sweep makes the previews of pending attachments and of those whose
+// processing was interrupted, until stop is done.
+func sweep(stop context.Context) {
+	ctx, cancel := context.WithTimeout(stop, settings.Timeout)
+	defer cancel()
+
+	rows, err := database.PostgresMain.DB.QueryContext(ctx, `
+		SELECT id FROM attachments
+		WHERE preview_status = $1 OR (preview_status = $2 AND preview_updated_at < now() - make_interval(secs => $3))
+		ORDER BY id
+		LIMIT $4
+	`, PreviewPending, PreviewProcessing, settings.PreviewStaleAfter.Seconds(), settings.PreviewQueueSize)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	ids := []int64{}
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			log.Print(err)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, id := range ids {
+		if stop.Err() != nil {
+			return
+		}
+
+		preview(stop, id)
+	}
+}
+
+// preview claims attachment id and makes its previews, marking it ready, or
+// failed when the image cannot be read. Other errors, such as an unavailable
+// storage, leave it pending for the next sweep, as does stop being done.
+func preview(stop context.Context, id int64) {
+	ctx, cancel := context.WithTimeout(stop, settings.PreviewTimeout)
+	defer cancel()
+
+	var key string
+
+	// Another node or an earlier job may hold the attachment
+	err := database.PostgresMain.DB.QueryRowContext(ctx, `
+		UPDATE attachments
+		SET preview_status = $2, preview_updated_at = now()
+		WHERE id = $1 AND (preview_status = $3 OR (preview_status = $2 AND preview_updated_at < now() - make_interval(secs => $4)))
+		RETURNING object_key
+	`, id, PreviewProcessing, PreviewPending, settings.PreviewStaleAfter.Seconds()).Scan(&key)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Print(err)
+		}
+		return
+	}
+
+	status := PreviewReady
+
+	if err := makePreviews(ctx, id, key); err != nil {
+		log.Print(err)
+
+		status = PreviewPending
+		if terminal(err) {
+			status = PreviewFailed
+		}
+	}
+
+	// A job that ran out of time or was stopped is still released
+	ctx, cancel = context.WithTimeout(context.WithoutCancel(stop), settings.PreviewReleaseTimeout)
+	defer cancel()
+
+	_, err = database.PostgresMain.DB.ExecContext(ctx, `
+		UPDATE attachments SET preview_status = $2, preview_updated_at = now() WHERE id = $1
+	`, id, status)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if status != PreviewPending {
+		if err := announce(ctx, id); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// terminal reports whether err means the previews can never be made.
+func terminal(err error) bool {
+	return errors.Is(err, media.ErrMalformed) || errors.Is(err, media.ErrUnsupported) || errors.Is(err, media.ErrTooLarge)
+}
+
+// announce sends attachment id as an attachment.updated event to the room of
+// the message it was sent with, or to its owner until it is sent.
+func announce(ctx context.Context, id int64) error {
+	a, err := Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"message_id":     a.MessageID,
+		"receiver_class": a.ReceiverClass,
+		"attachment":     a,
+	}
+
+	if a.MessageID == nil || a.ReceiverClass == nil {
+		p, err := event.New(event.TypeAttachmentUpdated, "", payload)
+		if err != nil {
+			return err
+		}
+
+		return channel.ChatHub.BroadcastUsers([]int64{a.OwnerID}, p)
+	}
+
+	var room string
+
+	switch *a.ReceiverClass {
+	case "user":
+		var senderID, receiverID int64
+
+		err := database.PostgresMain.DB.QueryRowContext(ctx, `
+			SELECT sender_id, receiver_id FROM direct_messages WHERE id = $1
+		`, *a.MessageID).Scan(&senderID, &receiverID)
+		if err != nil {
+			return err
+		}
+
+		room = channel.DirectRoom(senderID, receiverID)
+
+	case "channel":
+		var channelID int64
+
+		err := database.PostgresMain.DB.QueryRowContext(ctx, `
+			SELECT channel_id FROM channel_messages WHERE id = $1
+		`, *a.MessageID).Scan(&channelID)
+		if err != nil {
+			return err
+		}
+
+		room = channel.ChannelRoom(channelID)
+
+	default:
+		return fmt.Errorf("invalid receiver_class: %s", *a.ReceiverClass)
+	}
+
+	p, err := event.New(event.TypeAttachmentUpdated, room, payload)
+	if err != nil {
+		return err
+	}
+
+	return channel.ChatHub.Broadcast(room, p)
+}
+
+// makePreviews stores a variant of the image under key for each of
+// ThumbnailSizes and records them with the image metadata.
+func makePreviews(ctx context.Context, id int64, key string) error {
+	r, _, err := storage.Files.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, settings.FileMaxSize+1))
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	img, err := media.Decode(data, settings.PreviewMaxPixels)
+	if err != nil {
+		return err
+	}
+
+	width, height := img.Size()
+
+	variants := []mmsg.AttachmentVariant{}
+
+	// Stored variants are removed again when they cannot be recorded
+	stored := []string{}
+
+	defer func() {
+		for _, key := range stored {
+			if err := storage.Files.Delete(context.Background(), key); err != nil {
+				log.Print(err)
+			}
+		}
+	}()
+
+	thumbnail := img
+
+	for _, size := range ThumbnailSizes {
+		thumbnail = thumbnail.Thumbnail(size.Max)
+
+		encoded, err := thumbnail.Encode()
+		if err != nil {
+			return err
+		}
+
+		variantKey, err := storage.NewKey()
+		if err != nil {
+			return err
+		}
+
+		if err := storage.Files.Put(ctx, variantKey, bytes.NewReader(encoded.Data), int64(len(encoded.Data)), encoded.ContentType); err != nil {
+			return err
+		}
+
+		stored = append(stored, variantKey)
+
+		variants = append(variants, mmsg.AttachmentVariant{
+			Name:        size.Name,
+			Key:         variantKey,
+			ContentType: encoded.ContentType,
+			Width:       encoded.Width,
+			Height:      encoded.Height,
+			Size:        int64(len(encoded.Data)),
+		})
+	}
+
+	// The smallest variant has the fewest pixels to count
+	color := thumbnail.DominantColor()
+
+	if err := recordPreviews(ctx, id, width, height, color, variants); err != nil {
+		return err
+	}
+
+	// The variants are kept
+	stored = nil
+
+	return nil
+}
+
+// recordPreviews replaces the variants of attachment id and sets its
+// metadata. The objects of replaced variants are queued for deletion by
+// trigger.
+func recordPreviews(ctx context.Context, id int64, width, height int, color string, variants []mmsg.AttachmentVariant) error {
+	tx, err := database.PostgresMain.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM attachment_variants WHERE attachment_id = $1`, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, v := range variants {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO attachment_variants (attachment_id, name, object_key, content_type, width, height, size)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, id, v.Name, v.Key, v.ContentType, v.Width, v.Height, v.Size)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE attachments SET width = $2, height = $3, dominant_color = NULLIF($4, '') WHERE id = $1
+	`, id, width, height, color)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+
+		if err == nil {
+			err = errors.New("attachment: deleted while its previews were made")
+		}
+
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -185,6 +185,18 @@ func IsMember(channelID int64, userID int64) (bool, error) {
 	return exists, err
 }
 
+// IsAdmin reports whether userID is an admin member of the channel.
+func IsAdmin(ctx context.Context, channelID, userID int64) (bool, error) {
+	var exists bool
+	err := database.PostgresMain.DB.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM channel_members WHERE channel_id = $1 AND user_id = $2 AND role = 'admin'
+		)
+	`, channelID, userID).Scan(&exists)
+
+	return exists, err
+}
+
 func IsChannelCreator(ctx context.Context, channelID, userID int64) (bool, error) {
 	var createdBy int64
 	err := database.PostgresMain.DB.QueryRowContext(ctx, `
@@ -217,7 +229,7 @@ func GetChannelListWithLatestMessage(ctx context.Context, userID int64) ([]*mcha
 			SELECT DISTINCT ON (cm.channel_id)
 				cm.channel_id,
 				cm.id AS message_id,
-				cm.message,
+				CASE WHEN cm.deleted_at IS NULL THEN cm.message ELSE '' END AS message,
 				cm.sent_at
 			FROM channel_messages cm
 			ORDER BY cm.channel_id, cm.sent_at DESC
@@ -229,12 +241,20 @@ func GetChannelListWithLatestMessage(ctx context.Context, userID int64) ([]*mcha
 			ARRAY_AGG(cm_all.user_id) AS user_ids,
 			lm.message_id,
 			lm.message,
-			lm.sent_at
+			lm.sent_at,
+			(
+				SELECT COUNT(*)
+				FROM channel_messages unread
+				WHERE unread.channel_id = c.id AND unread.sender_id <> $1
+					AND unread.id > COALESCE(rp.last_read_id, 0) AND unread.deleted_at IS NULL
+			),
+			rp.last_read_id
 		FROM channels c
 		JOIN channel_members cm_filter ON cm_filter.channel_id = c.id AND cm_filter.user_id = $1
 		JOIN channel_members cm_all ON cm_all.channel_id = c.id
 		LEFT JOIN latest_messages lm ON lm.channel_id = c.id
-		GROUP BY c.id, c.name, c.created_by, lm.message_id, lm.message, lm.sent_at
+		LEFT JOIN read_positions rp ON rp.user_id = $1 AND rp.receiver_class = 'channel' AND rp.receiver_id = c.id
+		GROUP BY c.id, c.name, c.created_by, lm.message_id, lm.message, lm.sent_at, rp.last_read_id
 		ORDER BY lm.sent_at DESC NULLS LAST
 	`
 
@@ -247,7 +267,7 @@ func GetChannelListWithLatestMessage(ctx context.Context, userID int64) ([]*mcha
 	var results []*mchannel.ChannelWithMessage
 	for rows.Next() {
 		var ch mchannel.ChannelWithMessage
-		if err := rows.Scan(&ch.ID, &ch.Name, &ch.CreatedBy, pq.Array(&ch.UserIDs), &ch.MessageID, &ch.Message, &ch.SentAt); err != nil {
+		if err := rows.Scan(&ch.ID, &ch.Name, &ch.CreatedBy, pq.Array(&ch.UserIDs), &ch.MessageID, &ch.Message, &ch.SentAt, &ch.UnreadCount, &ch.LastReadID); err != nil {
 			return nil, err
 		}
 		results = append(results, &ch)
@@ -255,3 +275,24 @@ func GetChannelListWithLatestMessage(ctx context.Context, userID int64) ([]*mcha
 
 	return results, nil
 }
+
+func GetMemberIDs(ctx context.Context, channelID int64) ([]int64, error) {
+	rows, err := database.PostgresMain.DB.QueryContext(ctx, `
+		SELECT user_id FROM channel_members WHERE channel_id = $1
+	`, channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+
+	return userIDs, rows.Err()
+}
@@ -14,20 +14,33 @@ func GetDMListByUserID(ctx context.Context, userID int64) ([]*mdm.DMListItem, er
 				id,
 				sender_id,
 				receiver_id,
-				message,
+				CASE WHEN sender_id = $1 THEN receiver_id ELSE sender_id END AS other_id,
+				CASE WHEN deleted_at IS NULL THEN message ELSE '' END AS message,
 				sent_at
 			FROM direct_messages
 			WHERE sender_id = $1 OR receiver_id = $1
 			ORDER BY LEAST(sender_id, receiver_id), GREATEST(sender_id, receiver_id), sent_at DESC
 		)
 		SELECT 
-			id,
-			sender_id,
-			receiver_id,
-			message,
-			sent_at
-		FROM latest_messages
-		ORDER BY sent_at DESC
+			lm.id,
+			lm.sender_id,
+			lm.receiver_id,
+			lm.message,
+			lm.sent_at,
+			(
+				SELECT COUNT(*)
+				FROM direct_messages unread
+				WHERE unread.sender_id = lm.other_id AND unread.receiver_id = $1 AND unread.sender_id <> $1
+					AND unread.id > COALESCE(mine.last_read_id, 0) AND unread.deleted_at IS NULL
+			),
+			mine.last_read_id,
+			theirs.last_read_id
+		FROM latest_messages lm
+		LEFT JOIN read_positions mine
+			ON mine.user_id = $1 AND mine.receiver_class = 'user' AND mine.receiver_id = lm.other_id
+		LEFT JOIN read_positions theirs
+			ON theirs.user_id = lm.other_id AND theirs.receiver_class = 'user' AND theirs.receiver_id = $1
+		ORDER BY lm.sent_at DESC
 	`
 
 	rows, err := database.PostgresMain.DB.QueryContext(ctx, query, userID)
@@ -39,7 +52,10 @@ func GetDMListByUserID(ctx context.Context, userID int64) ([]*mdm.DMListItem, er
 	var results []*mdm.DMListItem
 	for rows.Next() {
 		var item mdm.DMListItem
-		if err := rows.Scan(&item.ID, &item.SenderID, &item.ReceiverID, &item.Message, &item.SentAt); err != nil {
+		if err := rows.Scan(
+			&item.ID, &item.SenderID, &item.ReceiverID, &item.Message, &item.SentAt,
+			&item.UnreadCount, &item.LastReadID, &item.CounterpartLastReadID,
+		); err != nil {
 			return nil, err
 		}
 		results = append(results, &item)
@@ -3,90 +3,1027 @@ package service
 import (
 	"chatbox/pkg/database"
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
 
 	mmsg "chatbox/app/model/message"
+	schannel "chatbox/app/service/channel"
+	snotification "chatbox/app/service/notification"
 
+	"chatbox/pkg/channel"
+	"chatbox/pkg/channel/event"
+	"chatbox/pkg/settings"
 	"chatbox/pkg/util"
 )
 
-func Insert(ctx context.Context, msg *mmsg.Message) (*mmsg.Message, error) {
+var (
+	ErrNotSender = errors.New("message: not the sender")
+
+	ErrNotMember = errors.New("message: not a member of the channel")
+
+	ErrEditWindow = errors.New("message: edit window has passed")
+
+	ErrNotPermitted = errors.New("message: neither the sender nor a channel admin")
+
+	ErrInvalidParent = errors.New("message: parent is not a message of the conversation that starts a thread")
+
+	ErrInvalidCursor = errors.New("message: invalid cursor")
+
+	ErrInvalidAttachment = errors.New("message: attachment not found, not uploaded by the sender or already sent")
+
+	ErrEmpty = errors.New("message: neither text nor attachments")
+)
+
+// Cursor directions
+const (
+	CursorBefore string = "before"
+
+	CursorAfter string = "after"
+)
+
+// Room returns the hub room a message is delivered to.
+func Room(msg *mmsg.Message) string {
+	if msg.ReceiverClass == "user" {
+		return channel.DirectRoom(msg.Sender.ID, *msg.ReceiverID)
+	}
+
+	return channel.ChannelRoom(*msg.ReceiverID)
+}
+
+// lockRoom serializes the sends to room across every node, so that the
+// messages of a room are stored and reach the hub in id order, and a client
+// resuming after the last id it received misses none. The lock is a session
+// advisory lock held by the returned connection; unlock releases both.
+func lockRoom(ctx context.Context, room string) (conn *sql.Conn, unlock func(), err error) {
+	conn, err = database.PostgresMain.DB.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext('rooms'), hashtext($1))`, room); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	unlock = func() {
+		// ctx may be done by now
+		ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+		defer cancel()
+
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock(hashtext('rooms'), hashtext($1))`, room); err != nil {
+			log.Print(err)
+
+			// A connection still holding the lock is closed rather than
+			// returned to the pool, which releases it
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+
+		conn.Close()
+	}
+
+	return conn, unlock, nil
+}
+
+// Send stores msg and broadcasts the stored message to its room as a
+// message.created event. Both the REST and the websocket transports deliver
+// messages through Send; clientID is echoed so the sender can match the event.
+// Sends to a room are serialized by lockRoom, so its events are in id order.
+func Send(ctx context.Context, msg *mmsg.Message, clientID string) (*mmsg.Message, error) {
+	if msg.ReceiverClass != "user" && msg.ReceiverClass != "channel" {
+		return nil, fmt.Errorf("invalid receiver_class: %s", msg.ReceiverClass)
+	}
+
+	// A message may be only attachments
+	if strings.TrimSpace(msg.Message) == "" && len(msg.AttachmentIDs) == 0 {
+		return nil, ErrEmpty
+	}
+
+	if msg.ParentID != nil {
+		if err := checkParent(ctx, msg); err != nil {
+			return nil, err
+		}
+	}
+
+	room := Room(msg)
+
+	conn, unlock, err := lockRoom(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := Insert(ctx, conn, msg)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	p, err := event.Reply(event.TypeMessageCreated, room, result, clientID, "")
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	if err := channel.ChatHub.Broadcast(room, p); err != nil {
+		log.Print(err)
+	}
+
+	unlock()
+
+	if result.ParentID != nil {
+		broadcastThread(ctx, room, result.ReceiverClass, *result.ParentID)
+	}
+
+	notify(ctx, room, result)
+
+	return result, nil
+}
+
+// checkParent makes sure the parent of msg belongs to the same conversation
+// and is not itself a reply, as threads do not nest.
+func checkParent(ctx context.Context, msg *mmsg.Message) error {
+	sender, receiverID, parentID, err := Locate(ctx, *msg.ParentID, msg.ReceiverClass)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInvalidParent
+		}
+		return err
+	}
+
+	parent := &mmsg.Message{Sender: mmsg.User{ID: sender}, ReceiverID: &receiverID, ReceiverClass: msg.ReceiverClass}
+
+	if parentID != nil || Room(parent) != Room(msg) {
+		return ErrInvalidParent
+	}
+
+	return nil
+}
+
+// Locate returns the sender, the receiver (the channel for channel messages)
+// and the parent of a message that is not deleted.
+func Locate(ctx context.Context, id int64, receiverClass string) (int64, int64, *int64, error) {
+	return locate(ctx, id, receiverClass, " AND deleted_at IS NULL")
+}
+
+// LocateAny is Locate for deleted messages too, which remain in the
+// conversation as tombstones.
+func LocateAny(ctx context.Context, id int64, receiverClass string) (int64, int64, *int64, error) {
+	return locate(ctx, id, receiverClass, "")
+}
+
+func locate(ctx context.Context, id int64, receiverClass, cond string) (int64, int64, *int64, error) {
+	var query string
+
+	switch receiverClass {
+	case "user":
+		query = `SELECT sender_id, receiver_id, parent_id FROM direct_messages WHERE id = $1` + cond
+	case "channel":
+		query = `SELECT sender_id, channel_id, parent_id FROM channel_messages WHERE id = $1` + cond
+	default:
+		return 0, 0, nil, fmt.Errorf("invalid receiver_class: %s", receiverClass)
+	}
+
+	var (
+		sender, receiverID int64
+		parentID           *int64
+	)
+
+	err := database.PostgresMain.DB.QueryRowContext(ctx, query, id).Scan(&sender, &receiverID, &parentID)
+
+	return sender, receiverID, parentID, err
+}
+
+// ThreadSummary returns the reply count, last reply time and participants of
+// the thread started by parentID.
+func ThreadSummary(ctx context.Context, parentID int64, receiverClass string) (*mmsg.Thread, error) {
+	var query string
+
+	switch receiverClass {
+	case "user":
+		query = `
+			SELECT COUNT(*), MAX(sent_at), ARRAY_AGG(DISTINCT sender_id)
+			FROM direct_messages
+			WHERE parent_id = $1 AND deleted_at IS NULL
+		`
+	case "channel":
+		query = `
+			SELECT COUNT(*), MAX(sent_at), ARRAY_AGG(DISTINCT sender_id)
+			FROM channel_messages
+			WHERE parent_id = $1 AND deleted_at IS NULL
+		`
+	default:
+		return nil, fmt.Errorf("invalid receiver_class: %s", receiverClass)
+	}
+
+	thread := &mmsg.Thread{ParentID: parentID}
+
+	var participants pq.Int64Array
+
+	err := database.PostgresMain.DB.QueryRowContext(ctx, query, parentID).Scan(&thread.ReplyCount, &thread.LastReplyAt, &participants)
+	if err != nil {
+		return nil, err
+	}
+
+	thread.Participants = participants
+	if thread.Participants == nil {
+		thread.Participants = []int64{}
+	}
+
+	return thread, nil
+}
+
+// CountReplies returns the number of replies to parentID, tombstones
+// included, and how many of them are deleted. The replies that are not
+// deleted are the reply count of ThreadSummary.
+func CountReplies(ctx context.Context, parentID int64, receiverClass string) (int64, int64, error) {
+	var query string
+
+	switch receiverClass {
+	case "user":
+		query = `SELECT COUNT(*), COUNT(*) FILTER (WHERE deleted_at IS NOT NULL) FROM direct_messages WHERE parent_id = $1`
+	case "channel":
+		query = `SELECT COUNT(*), COUNT(*) FILTER (WHERE deleted_at IS NOT NULL) FROM channel_messages WHERE parent_id = $1`
+	default:
+		return 0, 0, fmt.Errorf("invalid receiver_class: %s", receiverClass)
+	}
+
+	var total, deleted int64
+
+	err := database.PostgresMain.DB.QueryRowContext(ctx, query, parentID).Scan(&total, &deleted)
+
+	return total, deleted, err
+}
+
+// broadcastThread sends the current summary of a thread to its room as a
+// thread.updated event, so clients can refresh thread badges.
+func broadcastThread(ctx context.Context, room, receiverClass string, parentID int64) {
+	thread, err := ThreadSummary(ctx, parentID, receiverClass)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	p, err := event.New(event.TypeThreadUpdated, room, thread)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if err := channel.ChatHub.Broadcast(room, p); err != nil {
+		log.Print(err)
+	}
+}
+
+// Edit replaces the text of a message sent by senderID no longer than
+// settings.MessageEditWindow ago. The prior text is kept in message_edits and
+// the edited message is broadcast to its room as a message.edited event.
+func Edit(ctx context.Context, id int64, receiverClass string, senderID int64, text, clientID string) (*mmsg.Message, error) {
+	var query, update string
+
+	switch receiverClass {
+	case "user":
+		query = `
+			SELECT sender_id, receiver_id, sent_at, message, TRUE
+			FROM direct_messages
+			WHERE id = $1 AND deleted_at IS NULL
+			FOR UPDATE
+		`
+		update = `UPDATE direct_messages SET message = $1, is_edited = TRUE, edited_at = now() WHERE id = $2`
+	case "channel":
+		query = `
+			SELECT chm.sender_id, chm.channel_id, chm.sent_at, chm.message, EXISTS (
+				SELECT 1 FROM channel_members cm WHERE cm.channel_id = chm.channel_id AND cm.user_id = chm.sender_id
+			)
+			FROM channel_messages chm
+			WHERE chm.id = $1 AND chm.deleted_at IS NULL
+			FOR UPDATE OF chm
+		`
+		update = `UPDATE channel_messages SET message = $1, is_edited = TRUE, edited_at = now() WHERE id = $2`
+	default:
+		return nil, fmt.Errorf("invalid receiver_class: %s", receiverClass)
+	}
+
+	tx, err := database.PostgresMain.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sender, receiverID int64
+		sentAt             time.Time
+		prior              string
+		member             bool
+	)
+
+	err = tx.QueryRowContext(ctx, query, id).Scan(&sender, &receiverID, &sentAt, &prior, &member)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	switch {
+	case sender != senderID:
+		err = ErrNotSender
+	case !member:
+		err = ErrNotMember
+	case time.Since(sentAt) > settings.MessageEditWindow:
+		err = ErrEditWindow
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO message_edits (receiver_class, message_id, message, edited_by)
+		VALUES ($1, $2, $3, $4)
+	`, receiverClass, id, prior, senderID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, update, text, id); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	room := Room(&mmsg.Message{Sender: mmsg.User{ID: sender}, ReceiverID: &receiverID, ReceiverClass: receiverClass})
+
+	result, err := get(ctx, id, receiverClass, receiverID)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := event.Reply(event.TypeMessageEdited, room, result, clientID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := channel.ChatHub.Broadcast(room, p); err != nil {
+		log.Print(err)
+	}
+
+	return result, nil
+}
+
+// Delete removes a message on behalf of userID, who must be its sender or,
+// for a channel message, an admin of the channel. The row is kept and later
+// fetches return it as a tombstone without its text. A message.deleted
+// event carrying the tombstone is broadcast to the room of the message.
+func Delete(ctx context.Context, id int64, receiverClass string, userID int64, clientID string) (*mmsg.Message, error) {
+	var query, update string
+
+	switch receiverClass {
+	case "user":
+		query = `
+			SELECT sender_id, receiver_id, FALSE
+			FROM direct_messages
+			WHERE id = $1 AND deleted_at IS NULL
+			FOR UPDATE
+		`
+		update = `UPDATE direct_messages SET deleted_at = now(), deleted_by = $1 WHERE id = $2`
+	case "channel":
+		query = `
+			SELECT chm.sender_id, chm.channel_id, EXISTS (
+				SELECT 1 FROM channel_members cm WHERE cm.channel_id = chm.channel_id AND cm.user_id = $2 AND cm.role = 'admin'
+			)
+			FROM channel_messages chm
+			WHERE chm.id = $1 AND chm.deleted_at IS NULL
+			FOR UPDATE OF chm
+		`
+		update = `UPDATE channel_messages SET deleted_at = now(), deleted_by = $1 WHERE id = $2`
+	default:
+		return nil, fmt.Errorf("invalid receiver_class: %s", receiverClass)
+	}
+
+	tx, err := database.PostgresMain.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sender, receiverID int64
+		admin              bool
+	)
+
+	args := []interface{}{id}
+	if receiverClass == "channel" {
+		args = append(args, userID)
+	}
+
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&sender, &receiverID, &admin); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if sender != userID && !admin {
+		tx.Rollback()
+		return nil, ErrNotPermitted
+	}
+
+	if _, err := tx.ExecContext(ctx, update, userID, id); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	room := Room(&mmsg.Message{Sender: mmsg.User{ID: sender}, ReceiverID: &receiverID, ReceiverClass: receiverClass})
+
+	result, err := get(ctx, id, receiverClass, receiverID)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := event.Reply(event.TypeMessageDeleted, room, result, clientID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := channel.ChatHub.Broadcast(room, p); err != nil {
+		log.Print(err)
+	}
+
+	if result.ParentID != nil {
+		broadcastThread(ctx, room, receiverClass, *result.ParentID)
+	}
+
+	return result, nil
+}
+
+var shortcodeRegExp = regexp.MustCompile(`^:[a-z0-9_+-]{1,64}:$`)
+
+// ValidEmoji reports whether emoji is a :shortcode: or a short sequence of
+// unicode symbols, which may include keycap digits and joiners.
+func ValidEmoji(emoji string) bool {
+	if shortcodeRegExp.MatchString(emoji) {
+		return true
+	}
+
+	if emoji == "" || utf8.RuneCountInString(emoji) > 16 {
+		return false
+	}
+
+	symbol := false
+
+	for _, r := range emoji {
+		switch {
+		case r >= utf8.RuneSelf:
+			if unicode.IsLetter(r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+				return false
+			}
+			symbol = true
+		case r == '#' || r == '*' || (r >= '0' && r <= '9'):
+		default:
+			return false
+		}
+	}
+
+	return symbol
+}
+
+// React adds or removes the reaction of userID with emoji on a message and
+// broadcasts the new count of emoji to the room of the message. The reaction
+// event is only sent when the reaction changed.
+func React(ctx context.Context, id int64, receiverClass string, userID int64, emoji string, add bool, clientID string) error {
+	sender, receiverID, parentID, err := Locate(ctx, id, receiverClass)
+	if err != nil {
+		return err
+	}
+
+	// Only the users of the conversation may react
+	switch receiverClass {
+	case "user":
+		if userID != sender && userID != receiverID {
+			return sql.ErrNoRows
+		}
+	case "channel":
+		isMember, err := schannel.IsMember(receiverID, userID)
+		if err != nil {
+			return err
+		}
+		if !isMember {
+			return ErrNotMember
+		}
+	}
+
+	var (
+		query string
+		typ   string
+	)
+
+	if add {
+		query = `
+			INSERT INTO message_reactions (receiver_class, message_id, user_id, emoji)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT DO NOTHING
+		`
+		typ = event.TypeReactionAdded
+	} else {
+		query = `
+			DELETE FROM message_reactions
+			WHERE receiver_class = $1 AND message_id = $2 AND user_id = $3 AND emoji = $4
+		`
+		typ = event.TypeReactionRemoved
+	}
+
+	result, err := database.PostgresMain.DB.ExecContext(ctx, query, receiverClass, id, userID, emoji)
+	if err != nil {
+		return err
+	}
+
+	if changed, err := result.RowsAffected(); err != nil || changed == 0 {
+		return err
+	}
+
+	var count int64
+	err = database.PostgresMain.DB.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM message_reactions WHERE receiver_class = $1 AND message_id = $2 AND emoji = $3
+	`, receiverClass, id, emoji).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	room := Room(&mmsg.Message{Sender: mmsg.User{ID: sender}, ReceiverID: &receiverID, ReceiverClass: receiverClass})
+
+	p, err := event.Reply(typ, room, map[string]interface{}{
+		"message_id": id,
+		"parent_id":  parentID,
+		"user_id":    userID,
+		"emoji":      emoji,
+		"count":      count,
+	}, clientID, "")
+	if err != nil {
+		return err
+	}
+
+	if err := channel.ChatHub.Broadcast(room, p); err != nil {
+		log.Print(err)
+	}
+
+	return nil
+}
+
+// MarkRead moves the read position of userID in the conversation with
+// receiverID, the channel id for channel messages, up to messageID or, when
+// messageID is zero, to the latest message. Positions never move back. The
+// new position is sent as read.updated to the other connections of userID
+// and, for direct messages, to the other user.
+func MarkRead(ctx context.Context, userID int64, receiverClass string, receiverID, messageID int64) (int64, error) {
+	var (
+		query string
+		args  []interface{}
+	)
+
+	switch receiverClass {
+	case "user":
+		query = `
+			SELECT id FROM direct_messages
+			WHERE ((sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1))
+				AND ($3 = 0 OR id = $3)
+			ORDER BY id DESC
+			LIMIT 1
+		`
+		args = []interface{}{userID, receiverID, messageID}
+	case "channel":
+		query = `
+			SELECT id FROM channel_messages
+			WHERE channel_id = $1 AND ($2 = 0 OR id = $2)
+			ORDER BY id DESC
+			LIMIT 1
+		`
+		args = []interface{}{receiverID, messageID}
+	default:
+		return 0, fmt.Errorf("invalid receiver_class: %s", receiverClass)
+	}
+
+	var lastReadID int64
+
+	// The message must belong to the conversation
+	err := database.PostgresMain.DB.QueryRowContext(ctx, query, args...).Scan(&lastReadID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = database.PostgresMain.DB.QueryRowContext(ctx, `
+		INSERT INTO read_positions (user_id, receiver_class, receiver_id, last_read_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, receiver_class, receiver_id) DO UPDATE
+		SET last_read_id = GREATEST(read_positions.last_read_id, EXCLUDED.last_read_id), updated_at = now()
+		RETURNING last_read_id
+	`, userID, receiverClass, receiverID, lastReadID).Scan(&lastReadID)
+	if err != nil {
+		return 0, err
+	}
+
+	room := Room(&mmsg.Message{Sender: mmsg.User{ID: userID}, ReceiverID: &receiverID, ReceiverClass: receiverClass})
+
+	p, err := event.New(event.TypeReadUpdated, room, map[string]interface{}{
+		"user_id":      userID,
+		"last_read_id": lastReadID,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Channel read positions are private, direct message ones show as seen
+	if receiverClass == "channel" {
+		if err := channel.ChatHub.BroadcastUsers([]int64{userID}, p); err != nil {
+			log.Print(err)
+		}
+	} else {
+		if err := channel.ChatHub.Broadcast(room, p); err != nil {
+			log.Print(err)
+		}
+	}
+
+	return lastReadID, nil
+}
+
+// EditHistory returns the prior versions of a message, oldest first.
+func EditHistory(ctx context.Context, id int64, receiverClass string) ([]mmsg.Edit, error) {
+	rows, err := database.PostgresMain.DB.QueryContext(ctx, `
+		SELECT id, message_id, message, edited_by, edited_at
+		FROM message_edits
+		WHERE receiver_class = $1 AND message_id = $2
+		ORDER BY id ASC
+	`, receiverClass, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []mmsg.Edit{}
+
+	for rows.Next() {
+		var edit mmsg.Edit
+		if err := rows.Scan(&edit.ID, &edit.MessageID, &edit.Message, &edit.EditedBy, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+
+	return edits, rows.Err()
+}
+
+// ChannelID returns the channel a channel message was sent to.
+func ChannelID(ctx context.Context, id int64) (int64, error) {
+	var channelID int64
+	err := database.PostgresMain.DB.QueryRowContext(ctx, `
+		SELECT channel_id FROM channel_messages WHERE id = $1
+	`, id).Scan(&channelID)
+
+	return channelID, err
+}
+
+// EncodeCursor returns the opaque form of cursor handed to clients.
+func EncodeCursor(cursor mmsg.Cursor) string {
+	p, _ := json.Marshal(cursor)
+
+	return base64.RawURLEncoding.EncodeToString(p)
+}
+
+// DecodeCursor parses a cursor returned by EncodeCursor.
+func DecodeCursor(s string) (*mmsg.Cursor, error) {
+	p, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	cursor := new(mmsg.Cursor)
+	if err := json.Unmarshal(p, cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if cursor.Direction != CursorBefore && cursor.Direction != CursorAfter || cursor.ID <= 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return cursor, nil
+}
+
+// Anchor returns the position of a message of the conversation of userID
+// with receiverID, the channel id for channel messages.
+func Anchor(ctx context.Context, userID int64, receiverClass string, receiverID, id int64) (*mmsg.Cursor, error) {
+	var (
+		query string
+		args  []interface{}
+	)
+
+	switch receiverClass {
+	case "user":
+		query = `
+			SELECT id, sent_at FROM direct_messages
+			WHERE id = $1 AND ((sender_id = $2 AND receiver_id = $3) OR (sender_id = $3 AND receiver_id = $2))
+		`
+		args = []interface{}{id, userID, receiverID}
+	case "channel":
+		query = `
+			SELECT id, sent_at FROM channel_messages
+			WHERE id = $1 AND channel_id = $2
+		`
+		args = []interface{}{id, receiverID}
+	default:
+		return nil, fmt.Errorf("invalid receiver_class: %s", receiverClass)
+	}
+
+	cursor := new(mmsg.Cursor)
+
+	err := database.PostgresMain.DB.QueryRowContext(ctx, query, args...).Scan(&cursor.ID, &cursor.SentAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+// get returns one stored message sent to receiverID, the channel id for
+// channel messages, as seen by no user in particular.
+func get(ctx context.Context, id int64, receiverClass string, receiverID int64) (*mmsg.Message, error) {
+	var (
+		messages []mmsg.Message
+		err      error
+	)
+
+	switch receiverClass {
+	case "user":
+		messages, err = FetchDirectMessages(ctx, 0, receiverID, map[string][]string{"and": {"dm.id = ?"}}, []interface{}{id}, "dm.id", "ASC", 1, 0)
+	default:
+		messages, err = FetchChannelMessages(ctx, 0, receiverID, map[string][]string{"and": {"chm.id = ?"}}, []interface{}{id}, "chm.id", "ASC", 1, 0)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(messages) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return &messages[0], nil
+}
+
+// notify tells the receiver of a direct message, and the channel members
+// mentioned in a message, about it on their notification streams.
+func notify(ctx context.Context, room string, msg *mmsg.Message) {
+	if msg.ReceiverClass == "user" {
+		if err := snotification.Message(room, msg); err != nil {
+			log.Print(err)
+		}
+
+		return
+	}
+
+	usernames := Mentions(msg.Message)
+	if len(usernames) == 0 {
+		return
+	}
+
+	userIDs, err := mentionedMembers(ctx, *msg.ReceiverID, msg.Sender.ID, usernames)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if err := snotification.Mention(userIDs, room, msg); err != nil {
+		log.Print(err)
+	}
+}
+
+var mentionRegExp = regexp.MustCompile(`(?:^|\s)@([A-Za-z0-9_.-]+)`)
+
+// Mentions returns the distinct usernames mentioned with @ in text.
+func Mentions(text string) []string {
+	seen := map[string]bool{}
+	usernames := []string{}
+
+	for _, match := range mentionRegExp.FindAllStringSubmatch(text, -1) {
+		if username := match[1]; !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+
+	return usernames
+}
+
+func mentionedMembers(ctx context.Context, channelID, senderID int64, usernames []string) ([]int64, error) {
+	rows, err := database.PostgresMain.DB.QueryContext(ctx, `
+		SELECT u.id
+		FROM users u
+		JOIN channel_members cm ON cm.user_id = u.id
+		WHERE cm.channel_id = $1 AND u.id <> $2 AND u.username = ANY($3)
+	`, channelID, senderID, pq.Array(usernames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int64
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+
+	return userIDs, rows.Err()
+}
+
+// Insert stores msg with its attachments on conn, which holds the room lock.
+func Insert(ctx context.Context, conn *sql.Conn, msg *mmsg.Message) (*mmsg.Message, error) {
 	var query string
 
 	if msg.ReceiverClass == "user" {
 		query = `
-			INSERT INTO direct_messages (sender_id, receiver_id, message)
-			VALUES ($1, $2, $3)
-			RETURNING id, sent_at
+			WITH inserted AS (
+				INSERT INTO direct_messages (sender_id, receiver_id, message, parent_id)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, sender_id, sent_at
+			)
+			SELECT inserted.id, inserted.sent_at, sender.username, sender.firstname, sender.lastname
+			FROM inserted
+			JOIN users sender ON sender.id = inserted.sender_id
 		`
 	} else if msg.ReceiverClass == "channel" {
 		query = `
-			INSERT INTO channel_messages (sender_id, channel_id, message)
-			VALUES ($1, $2, $3)
-			RETURNING id, sent_at
+			WITH inserted AS (
+				INSERT INTO channel_messages (sender_id, channel_id, message, parent_id)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, sender_id, sent_at
+			)
+			SELECT inserted.id, inserted.sent_at, sender.username, sender.firstname, sender.lastname
+			FROM inserted
+			JOIN users sender ON sender.id = inserted.sender_id
 		`
 	} else {
 		return nil, fmt.Errorf("invalid receiver_class: %s", msg.ReceiverClass)
 	}
 
-	// Execute the query
-	var err error
-	if msg.ReceiverClass == "user" {
-		err = database.PostgresMain.DB.QueryRowContext(
-			ctx,
-			query,
-			msg.Sender.ID,
-			msg.ReceiverID,
-			msg.Message,
-		).Scan(&msg.ID, &msg.SentAt)
-	} else if msg.ReceiverClass == "channel" {
-		// Channel message
-		err = database.PostgresMain.DB.QueryRowContext(
-			ctx,
-			query,
-			msg.Sender.ID,
-			msg.ReceiverID,
-			msg.Message,
-		).Scan(&msg.ID, &msg.SentAt)
+	// The message and the link to its attachments are stored together
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
 	}
 
+	// Execute the query
+	err = tx.QueryRowContext(
+		ctx,
+		query,
+		msg.Sender.ID,
+		msg.ReceiverID,
+		msg.Message,
+		msg.ParentID,
+	).Scan(&msg.ID, &msg.SentAt, &msg.Sender.Username, &msg.Sender.Firstname, &msg.Sender.Lastname)
+
 	// Check for errors
 	if err != nil {
+		tx.Rollback()
 		log.Printf("Database error: %v, Query: %v", err, query)
 		return nil, err
 	}
 
+	if len(msg.AttachmentIDs) > 0 {
+		attachments, err := attach(ctx, tx, msg)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		msg.Attachments, msg.AttachmentIDs = attachments, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	return msg, nil
 }
 
+// attach links the attachments of msg to it. Each must have been uploaded by
+// the sender and not sent with another message yet.
+func attach(ctx context.Context, tx *sql.Tx, msg *mmsg.Message) ([]mmsg.Attachment, error) {
+	ids := map[int64]bool{}
+	for _, id := range msg.AttachmentIDs {
+		ids[id] = true
+	}
+
+	if len(ids) > settings.MessageAttachmentLimit {
+		return nil, ErrInvalidAttachment
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE attachments
+		SET receiver_class = $1, message_id = $2
+		WHERE id = ANY($3) AND owner_id = $4 AND message_id IS NULL
+		RETURNING
+			id, owner_id, filename, content_type, size, checksum, created_at,
+			width, height, dominant_color, preview_status,
+			ARRAY(SELECT v.name FROM attachment_variants v WHERE v.attachment_id = attachments.id ORDER BY v.width)
+	`, msg.ReceiverClass, msg.ID, pq.Array(msg.AttachmentIDs), msg.Sender.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []mmsg.Attachment{}
+
+	for rows.Next() {
+		var a mmsg.Attachment
+		err := rows.Scan(
+			&a.ID, &a.OwnerID, &a.Filename, &a.ContentType, &a.Size, &a.Checksum, &a.CreatedAt,
+			&a.Width, &a.Height, &a.DominantColor, &a.PreviewStatus,
+			pq.Array(&a.Previews),
+		)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(attachments) != len(ids) {
+		return nil, ErrInvalidAttachment
+	}
+
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].ID < attachments[j].ID })
+
+	return attachments, nil
+}
+
 func FetchDirectMessages(ctx context.Context, userID, receiverID int64, filter map[string][]string, args []interface{}, order, sort string, limit, offset int) ([]mmsg.Message, error) {
 	query := `
 			SELECT
-					dm.id, dm.message, dm.sent_at, dm.is_edited, dm.edited_at, dm.deleted_at,
+					dm.id, CASE WHEN dm.deleted_at IS NULL THEN dm.message ELSE '' END,
+					dm.sent_at, dm.is_edited, dm.edited_at, dm.deleted_at, dm.deleted_by, dm.parent_id,
 					sender.id, sender.username, sender.firstname, sender.lastname,
-					receiver.id, receiver.username, receiver.firstname, receiver.lastname
+					receiver.id, receiver.username, receiver.firstname, receiver.lastname,
+					thread.reply_count, thread.last_reply_at, thread.participants,
+					reactions.reactions, attachments.attachments
 			FROM direct_messages dm
 			JOIN users sender ON sender.id = dm.sender_id
 			JOIN users receiver ON receiver.id = dm.receiver_id
+			LEFT JOIN LATERAL (
+					SELECT COUNT(*) AS reply_count, MAX(r.sent_at) AS last_reply_at, ARRAY_AGG(DISTINCT r.sender_id) AS participants
+					FROM direct_messages r
+					WHERE r.parent_id = dm.id AND r.deleted_at IS NULL
+			) thread ON TRUE
+			LEFT JOIN LATERAL (
+					SELECT COALESCE(json_agg(json_build_object(
+							'emoji', r.emoji, 'count', r.count, 'reacted_by_me', r.mine
+					) ORDER BY r.first_at), '[]') AS reactions
+					FROM (
+							SELECT mr.emoji, COUNT(*) AS count, BOOL_OR(mr.user_id = ?) AS mine, MIN(mr.created_at) AS first_at
+							FROM message_reactions mr
+							WHERE mr.receiver_class = 'user' AND mr.message_id = dm.id
+							GROUP BY mr.emoji
+					) r
+			) reactions ON TRUE
+			LEFT JOIN LATERAL (
+					SELECT COALESCE(json_agg(json_build_object(
+							'id', a.id, 'owner_id', a.owner_id, 'filename', a.filename, 'content_type', a.content_type,
+							'size', a.size, 'checksum', a.checksum, 'created_at', a.created_at,
+							'width', a.width, 'height', a.height, 'dominant_color', a.dominant_color, 'preview_status', a.preview_status,
+							'previews', (SELECT json_agg(v.name ORDER BY v.width) FROM attachment_variants v WHERE v.attachment_id = a.id)
+					) ORDER BY a.id), '[]') AS attachments
+					FROM attachments a
+					WHERE a.receiver_class = 'user' AND a.message_id = dm.id AND dm.deleted_at IS NULL
+			) attachments ON TRUE
 	`
 
-	// Append filters
-	if q := strings.Join(filter["and"], " AND "); q != "" {
-		query += " WHERE " + q
-	}
+	// The viewer placeholder of the reactions comes before every filter
+	args = append([]interface{}{userID}, args...)
 
-	if q := strings.Join(filter["or"], " OR "); q != "" {
-		if !strings.Contains(query, "WHERE") {
-			query += " WHERE "
-		} else {
-			query += " AND "
-		}
-		query += "(" + q + ")"
-	}
+	// Append filters
+	query += where(filter)
 
-	query += fmt.Sprintf(" ORDER BY %s %s LIMIT ? OFFSET ?", order, sort)
+	// The id breaks ties so that pages neither skip nor repeat rows
+	query += fmt.Sprintf(" ORDER BY %s %s, dm.id %s LIMIT ? OFFSET ?", order, sort, sort)
 	args = append(args, limit, offset)
 
 	query, _ = util.ReplacePlaceholders(query, len(args))
@@ -102,15 +1039,35 @@ func FetchDirectMessages(ctx context.Context, userID, receiverID int64, filter m
 		var msg mmsg.Message
 		msg.Receiver = &mmsg.User{}
 
+		thread := new(mmsg.Thread)
+		var participants pq.Int64Array
+		var reactions, attachments []byte
+
 		err := rows.Scan(
-			&msg.ID, &msg.Message, &msg.SentAt, &msg.IsEdited, &msg.EditedAt, &msg.DeletedAt,
+			&msg.ID, &msg.Message, &msg.SentAt, &msg.IsEdited, &msg.EditedAt, &msg.DeletedAt, &msg.DeletedBy, &msg.ParentID,
 			&msg.Sender.ID, &msg.Sender.Username, &msg.Sender.Firstname, &msg.Sender.Lastname,
 			&msg.Receiver.ID, &msg.Receiver.Username, &msg.Receiver.Firstname, &msg.Receiver.Lastname,
+			&thread.ReplyCount, &thread.LastReplyAt, &participants,
+			&reactions, &attachments,
 		)
 		if err != nil {
 			return nil, err
 		}
 
+		if err := json.Unmarshal(reactions, &msg.Reactions); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(attachments, &msg.Attachments); err != nil {
+			return nil, err
+		}
+
+		// Only messages with replies carry a thread summary
+		if thread.ReplyCount > 0 {
+			thread.ParentID, thread.Participants = msg.ID, participants
+			msg.Thread = thread
+		}
+
 		msg.ReceiverClass = "user"
 		messages = append(messages, msg)
 	}
@@ -118,24 +1075,58 @@ func FetchDirectMessages(ctx context.Context, userID, receiverID int64, filter m
 	return messages, rows.Err()
 }
 
-func FetchChannelMessages(ctx context.Context, channelID int64, filter map[string][]string, args []interface{}, order, sort string, limit, offset int) ([]mmsg.Message, error) {
+func FetchChannelMessages(ctx context.Context, userID, channelID int64, filter map[string][]string, args []interface{}, order, sort string, limit, offset int) ([]mmsg.Message, error) {
 	query := `
 		SELECT
-			chm.id, chm.message, chm.sent_at, chm.is_edited, chm.edited_at, chm.deleted_at,
+			chm.id, CASE WHEN chm.deleted_at IS NULL THEN chm.message ELSE '' END,
+			chm.sent_at, chm.is_edited, chm.edited_at, chm.deleted_at, chm.deleted_by, chm.parent_id,
 			sender.id, sender.username, sender.firstname, sender.lastname,
-			NULL, NULL, NULL, NULL
+			NULL, NULL, NULL, NULL,
+			thread.reply_count, thread.last_reply_at, thread.participants,
+			reactions.reactions, attachments.attachments
 		FROM channel_messages chm
 		JOIN users sender ON sender.id = chm.sender_id
+		LEFT JOIN LATERAL (
+			SELECT COUNT(*) AS reply_count, MAX(r.sent_at) AS last_reply_at, ARRAY_AGG(DISTINCT r.sender_id) AS participants
+			FROM channel_messages r
+			WHERE r.parent_id = chm.id AND r.deleted_at IS NULL
+		) thread ON TRUE
+		LEFT JOIN LATERAL (
+			SELECT COALESCE(json_agg(json_build_object(
+				'emoji', r.emoji, 'count', r.count, 'reacted_by_me', r.mine
+			) ORDER BY r.first_at), '[]') AS reactions
+			FROM (
+				SELECT mr.emoji, COUNT(*) AS count, BOOL_OR(mr.user_id = ?) AS mine, MIN(mr.created_at) AS first_at
+				FROM message_reactions mr
+				WHERE mr.receiver_class = 'channel' AND mr.message_id = chm.id
+				GROUP BY mr.emoji
+			) r
+		) reactions ON TRUE
+		LEFT JOIN LATERAL (
+			SELECT COALESCE(json_agg(json_build_object(
+				'id', a.id, 'owner_id', a.owner_id, 'filename', a.filename, 'content_type', a.content_type,
+				'size', a.size, 'checksum', a.checksum, 'created_at', a.created_at,
+				'width', a.width, 'height', a.height, 'dominant_color', a.dominant_color, 'preview_status', a.preview_status,
+				'previews', (SELECT json_agg(v.name ORDER BY v.width) FROM attachment_variants v WHERE v.attachment_id = a.id)
+			) ORDER BY a.id), '[]') AS attachments
+			FROM attachments a
+			WHERE a.receiver_class = 'channel' AND a.message_id = chm.id AND chm.deleted_at IS NULL
+		) attachments ON TRUE
 		WHERE chm.channel_id = ?
 	`
 
-	args = append(args, channelID)
+	// The viewer and channel placeholders come before every filter
+	args = append([]interface{}{userID, channelID}, args...)
 
 	if q := strings.Join(filter["and"], " AND "); q != "" {
 		query += " AND " + q
 	}
 
-	query += fmt.Sprintf(" ORDER BY %s %s LIMIT ? OFFSET ?", order, sort)
+	if q := strings.Join(filter["or"], " OR "); q != "" {
+		query += " AND (" + q + ")"
+	}
+
+	query += fmt.Sprintf(" ORDER BY %s %s, chm.id %s LIMIT ? OFFSET ?", order, sort, sort)
 	args = append(args, limit, offset)
 
 	query, _ = util.ReplacePlaceholders(query, len(args))
@@ -154,15 +1145,34 @@ func FetchChannelMessages(ctx context.Context, channelID int64, filter map[strin
 		var recvID *int64
 		var recvUsername, recvFirstname, recvLastname *string
 
+		thread := new(mmsg.Thread)
+		var participants pq.Int64Array
+		var reactions, attachments []byte
+
 		err := rows.Scan(
-			&msg.ID, &msg.Message, &msg.SentAt, &msg.IsEdited, &msg.EditedAt, &msg.DeletedAt,
+			&msg.ID, &msg.Message, &msg.SentAt, &msg.IsEdited, &msg.EditedAt, &msg.DeletedAt, &msg.DeletedBy, &msg.ParentID,
 			&msg.Sender.ID, &msg.Sender.Username, &msg.Sender.Firstname, &msg.Sender.Lastname,
 			&recvID, &recvUsername, &recvFirstname, &recvLastname,
+			&thread.ReplyCount, &thread.LastReplyAt, &participants,
+			&reactions, &attachments,
 		)
 		if err != nil {
 			return nil, err
 		}
 
+		if err := json.Unmarshal(reactions, &msg.Reactions); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(attachments, &msg.Attachments); err != nil {
+			return nil, err
+		}
+
+		if thread.ReplyCount > 0 {
+			thread.ParentID, thread.Participants = msg.ID, participants
+			msg.Thread = thread
+		}
+
 		// Receiver is nil in channel messages (by design)
 		msg.Receiver = nil
 		msg.ReceiverID = &channelID
@@ -173,3 +1183,69 @@ func FetchChannelMessages(ctx context.Context, channelID int64, filter map[strin
 
 	return messages, rows.Err()
 }
+
+// where returns the WHERE clause of filter, or nothing when it is empty. The
+// "and" conditions must all hold and at least one of the "or" conditions.
+func where(filter map[string][]string) string {
+	conds := []string{}
+
+	if q := strings.Join(filter["and"], " AND "); q != "" {
+		conds = append(conds, q)
+	}
+
+	if q := strings.Join(filter["or"], " OR "); q != "" {
+		conds = append(conds, "("+q+")")
+	}
+
+	if len(conds) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// CountDirectMessages returns the number of direct messages that match filter.
+func CountDirectMessages(ctx context.Context, filter map[string][]string, args []interface{}) (int64, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM direct_messages dm
+		JOIN users sender ON sender.id = dm.sender_id
+	`
+
+	query += where(filter)
+
+	query, _ = util.ReplacePlaceholders(query, len(args))
+
+	var total int64
+	err := database.PostgresMain.DB.QueryRowContext(ctx, query, args...).Scan(&total)
+
+	return total, err
+}
+
+// CountChannelMessages returns the number of messages of a channel that match
+// filter.
+func CountChannelMessages(ctx context.Context, channelID int64, filter map[string][]string, args []interface{}) (int64, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM channel_messages chm
+		JOIN users sender ON sender.id = chm.sender_id
+		WHERE chm.channel_id = ?
+	`
+
+	args = append([]interface{}{channelID}, args...)
+
+	if q := strings.Join(filter["and"], " AND "); q != "" {
+		query += " AND " + q
+	}
+
+	if q := strings.Join(filter["or"], " OR "); q != "" {
+		query += " AND (" + q + ")"
+	}
+
+	query, _ = util.ReplacePlaceholders(query, len(args))
+
+	var total int64
+	err := database.PostgresMain.DB.QueryRowContext(ctx, query, args...).Scan(&total)
+
+	return total, err
+}
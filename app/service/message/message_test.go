@@ -0,0 +1,24 @@
+package service
+
+import "testing"
+
+func TestWhere(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter map[string][]string
+		want   string
+	}{
+		{"empty", map[string][]string{}, ""},
+		{"nil", nil, ""},
+		{"and", map[string][]string{"and": {"a = ?", "b = ?"}}, " WHERE a = ? AND b = ?"},
+		{"or", map[string][]string{"or": {"a = ?", "b = ?"}}, " WHERE (a = ? OR b = ?)"},
+		{"both", map[string][]string{"and": {"a = ?"}, "or": {"b = ?", "c = ?"}}, " WHERE a = ? AND (b = ? OR c = ?)"},
+		{"empty and", map[string][]string{"and": {}, "or": {"b = ?"}}, " WHERE (b = ?)"},
+	}
+
+	for _, tt := range tests {
+		if got := where(tt.filter); got != tt.want {
+			t.Errorf("%s: where() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"chatbox/pkg/channel"
+	"chatbox/pkg/channel/event"
+
+	mmsg "chatbox/app/model/message"
+	mnotification "chatbox/app/model/notification"
+)
+
+// Message notifies the receiver of a new direct message.
+func Message(room string, msg *mmsg.Message) error {
+	return notify([]int64{*msg.ReceiverID}, event.TypeNotificationMessage, room, msg)
+}
+
+// Mention notifies users mentioned in a message.
+func Mention(userIDs []int64, room string, msg *mmsg.Message) error {
+	return notify(userIDs, event.TypeNotificationMention, room, msg)
+}
+
+// Invite notifies users added to a channel.
+func Invite(userIDs []int64, invite *mnotification.Invite) error {
+	return notify(userIDs, event.TypeNotificationInvite, channel.ChannelRoom(invite.ChannelID), invite)
+}
+
+// Membership notifies channel members that someone joined or left, or that
+// the channel was deleted.
+func Membership(userIDs []int64, membership *mnotification.Membership) error {
+	return notify(userIDs, event.TypeNotificationMembership, channel.ChannelRoom(membership.ChannelID), membership)
+}
+
+// System notifies every connected user.
+func System(system *mnotification.System) error {
+	p, err := event.New(event.TypeNotificationSystem, "", system)
+	if err != nil {
+		return err
+	}
+
+	return channel.NotificationHub.BroadcastAll(p)
+}
+
+func notify(userIDs []int64, typ, room string, payload interface{}) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	p, err := event.New(typ, room, payload)
+	if err != nil {
+		return err
+	}
+
+	return channel.NotificationHub.BroadcastUsers(userIDs, p)
+}
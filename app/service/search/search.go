@@ -0,0 +1,338 @@
+package service
+
+import (
+	"chatbox/pkg/database"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+
+	msearch "chatbox/app/model/search"
+
+	"chatbox/pkg/util"
+)
+
+// Text search configuration. The simple configuration neither stems nor drops
+// stop words, so it works the same for every language people chat in.
+const config = "simple"
+
+// Matched words are delimited with control characters, removed from the
+// message beforehand, and marked up once the snippet is escaped
+const (
+	startSel = "\x02"
+
+	stopSel = "\x03"
+)
+
+// Options of the snippet of each result
+const headlineOptions = "StartSel=" + startSel + ", StopSel=" + stopSel + ", MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=\" … \""
+
+// The message without the delimiters
+const message = "translate(m.message, chr(2) || chr(3), '')"
+
+var marker = strings.NewReplacer(startSel, "<mark>", stopSel, "</mark>")
+
+var ErrInvalidDate = errors.New("search: dates must be formatted as YYYY-MM-DD")
+
+// Parse splits a search into its text and its operators:
+//
+//	from:alice      sent by the user alice
+//	in:#general     in the channel named general
+//	in:@bob         in the direct messages with bob
+//	before:2024-05-01, after:2024-04-01
+//	has:attachment
+//
+// Words in double quotes are matched as a phrase. Anything else, including
+// unknown operators, is searched as text.
+func Parse(q string) (*msearch.Query, error) {
+	query := new(msearch.Query)
+	text := []string{}
+
+	for _, token := range tokenize(q) {
+		op, value, found := strings.Cut(token, ":")
+		if !found || value == "" || strings.HasPrefix(token, `"`) {
+			text = append(text, token)
+			continue
+		}
+
+		op = strings.ToLower(op)
+
+		switch op {
+		case "from":
+			query.From = append(query.From, strings.ToLower(strings.TrimPrefix(value, "@")))
+
+		case "in":
+			if name, ok := strings.CutPrefix(value, "@"); ok {
+				query.Users = append(query.Users, strings.ToLower(name))
+			} else {
+				query.Channels = append(query.Channels, strings.ToLower(strings.TrimPrefix(value, "#")))
+			}
+
+		case "before", "after":
+			date, err := time.Parse(time.DateOnly, value)
+			if err != nil {
+				return nil, ErrInvalidDate
+			}
+
+			// Both are exclusive of the given day
+			if op == "before" {
+				query.Before = &date
+			} else {
+				date = date.AddDate(0, 0, 1)
+				query.After = &date
+			}
+
+		case "has":
+			if strings.ToLower(value) != "attachment" {
+				text = append(text, token)
+				continue
+			}
+			query.HasAttachment = true
+
+		default:
+			text = append(text, token)
+		}
+	}
+
+	query.Text = strings.Join(text, " ")
+
+	return query, nil
+}
+
+// tokenize splits q on spaces outside of double quotes.
+func tokenize(q string) []string {
+	var (
+		tokens []string
+		token  strings.Builder
+		quoted bool
+	)
+
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			token.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+
+	return tokens
+}
+
+// Messages searches every direct message and channel message userID can
+// read. Results are ranked by relevance, then newest first.
+func Messages(ctx context.Context, userID int64, query *msearch.Query, limit, offset int) ([]msearch.Result, error) {
+	q, args, err := statement(userID, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := database.PostgresMain.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []msearch.Result{}
+
+	for rows.Next() {
+		var result msearch.Result
+
+		err := rows.Scan(
+			&result.ReceiverClass, &result.ID, &result.ReceiverID, &result.ParentID, &result.SentAt, &result.Rank,
+			&result.Snippet,
+			&result.Sender.ID, &result.Sender.Username, &result.Sender.Firstname, &result.Sender.Lastname,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Snippet = snippet(result.Snippet)
+
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// snippet escapes a headline and marks up its matched words.
+func snippet(headline string) string {
+	return marker.Replace(html.EscapeString(headline))
+}
+
+// Count returns the number of messages Messages finds for query.
+func Count(ctx context.Context, userID int64, query *msearch.Query) (int64, error) {
+	var (
+		stmt  strings.Builder
+		args  []interface{}
+		total int64
+	)
+
+	if query.Text != "" {
+		stmt.WriteString(fmt.Sprintf("WITH search AS (SELECT websearch_to_tsquery('%s', ?) AS query)\n", config))
+		args = append(args, query.Text)
+	}
+
+	sources, args := union(userID, query, args)
+
+	stmt.WriteString("SELECT COUNT(*) FROM (" + sources + ") m")
+
+	q, err := util.ReplacePlaceholders(stmt.String(), len(args))
+	if err != nil {
+		return 0, err
+	}
+
+	err = database.PostgresMain.DB.QueryRowContext(ctx, q, args...).Scan(&total)
+
+	return total, err
+}
+
+// statement builds the query of Messages, a union of the direct and channel
+// messages userID can read.
+func statement(userID int64, query *msearch.Query, limit, offset int) (string, []interface{}, error) {
+	var (
+		stmt strings.Builder
+		args []interface{}
+	)
+
+	// Without text only the operators filter
+	headline, search := message, ""
+
+	if query.Text != "" {
+		stmt.WriteString(fmt.Sprintf("WITH search AS (SELECT websearch_to_tsquery('%s', ?) AS query)\n", config))
+		args = append(args, query.Text, headlineOptions)
+
+		headline = fmt.Sprintf("ts_headline('%s', %s, search.query, ?)", config, message)
+		search = "CROSS JOIN search"
+	}
+
+	sources, args := union(userID, query, args)
+
+	stmt.WriteString(fmt.Sprintf(`
+		SELECT
+			m.receiver_class, m.id, m.receiver_id, m.parent_id, m.sent_at, m.rank,
+			%s,
+			sender.id, sender.username, sender.firstname, sender.lastname
+		FROM (
+			%s
+			ORDER BY rank DESC, sent_at DESC, id DESC
+			LIMIT ? OFFSET ?
+		) m
+		%s
+		JOIN users sender ON sender.id = m.sender_id
+		ORDER BY m.rank DESC, m.sent_at DESC, m.id DESC
+	`, headline, sources, search))
+	args = append(args, limit, offset)
+
+	q, err := util.ReplacePlaceholders(stmt.String(), len(args))
+
+	return q, args, err
+}
+
+// union returns the messages userID can read that match query, as a union of
+// the direct and channel messages, and appends its arguments to args. The
+// search CTE of the text must precede it.
+func union(userID int64, query *msearch.Query, args []interface{}) (string, []interface{}) {
+	// {t} is the message table alias
+	match, rank := "", "0"
+
+	if query.Text != "" {
+		match = " AND {t}.search_vector @@ search.query"
+		rank = "ts_rank({t}.search_vector, search.query)"
+	}
+
+	// Sources of the union; in: operators may leave one of them out
+	sources := []string{}
+
+	if len(query.Channels) == 0 || len(query.Users) > 0 {
+		from := "direct_messages dm"
+		if query.Text != "" {
+			from += " CROSS JOIN search"
+		}
+
+		conds := []string{"(dm.sender_id = ? OR dm.receiver_id = ?)", "dm.deleted_at IS NULL"}
+		args = append(args, userID, userID, userID)
+
+		if len(query.Users) > 0 {
+			conds = append(conds, "(CASE WHEN dm.sender_id = ? THEN dm.receiver_id ELSE dm.sender_id END) IN (SELECT id FROM users WHERE LOWER(username) = ANY(?))")
+			args = append(args, userID, pq.Array(query.Users))
+		}
+
+		conds, args = common(conds, args, "dm", "user", query)
+
+		sources = append(sources, fmt.Sprintf(`
+			SELECT 'user' AS receiver_class, dm.id, dm.message, dm.sent_at, dm.parent_id, dm.sender_id,
+				CASE WHEN dm.sender_id = ? THEN dm.receiver_id ELSE dm.sender_id END AS receiver_id,
+				%s AS rank
+			FROM %s
+			WHERE %s%s
+		`, strings.ReplaceAll(rank, "{t}", "dm"), from, strings.Join(conds, " AND "), strings.ReplaceAll(match, "{t}", "dm")))
+	}
+
+	if len(query.Users) == 0 || len(query.Channels) > 0 {
+		from := "channel_messages chm JOIN channel_members cm ON cm.channel_id = chm.channel_id AND cm.user_id = ?"
+		if query.Text != "" {
+			from += " CROSS JOIN search"
+		}
+
+		conds := []string{"chm.deleted_at IS NULL"}
+		args = append(args, userID)
+
+		if len(query.Channels) > 0 {
+			conds = append(conds, "chm.channel_id IN (SELECT id FROM channels WHERE LOWER(name) = ANY(?))")
+			args = append(args, pq.Array(query.Channels))
+		}
+
+		conds, args = common(conds, args, "chm", "channel", query)
+
+		sources = append(sources, fmt.Sprintf(`
+			SELECT 'channel' AS receiver_class, chm.id, chm.message, chm.sent_at, chm.parent_id, chm.sender_id,
+				chm.channel_id AS receiver_id,
+				%s AS rank
+			FROM %s
+			WHERE %s%s
+		`, strings.ReplaceAll(rank, "{t}", "chm"), from, strings.Join(conds, " AND "), strings.ReplaceAll(match, "{t}", "chm")))
+	}
+
+	return strings.Join(sources, " UNION ALL "), args
+}
+
+// common appends the conditions of the operators that apply to both message
+// tables, table being the alias of the one of receiverClass being searched.
+func common(conds []string, args []interface{}, table, receiverClass string, query *msearch.Query) ([]string, []interface{}) {
+	if len(query.From) > 0 {
+		conds = append(conds, table+".sender_id IN (SELECT id FROM users WHERE LOWER(username) = ANY(?))")
+		args = append(args, pq.Array(query.From))
+	}
+
+	if query.Before != nil {
+		conds = append(conds, table+".sent_at < ?")
+		args = append(args, *query.Before)
+	}
+
+	if query.After != nil {
+		conds = append(conds, table+".sent_at >= ?")
+		args = append(args, *query.After)
+	}
+
+	if query.HasAttachment {
+		conds = append(conds, fmt.Sprintf("EXISTS (SELECT 1 FROM attachments a WHERE a.receiver_class = '%s' AND a.message_id = %s.id)", receiverClass, table))
+	}
+
+	return conds, args
+}
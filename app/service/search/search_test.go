@@ -0,0 +1,155 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	msearch "chatbox/app/model/search"
+)
+
+func date(s string) *time.Time {
+	d, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		panic(err)
+	}
+
+	return &d
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		q       string
+		want    *msearch.Query
+		wantErr error
+	}{
+		{
+			name: "text",
+			q:    "lunch plans",
+			want: &msearch.Query{Text: "lunch plans"},
+		},
+		{
+			name: "phrase",
+			q:    `"lunch plans" today`,
+			want: &msearch.Query{Text: `"lunch plans" today`},
+		},
+		{
+			name: "operator in a phrase",
+			q:    `"from: alice"`,
+			want: &msearch.Query{Text: `"from: alice"`},
+		},
+		{
+			name: "from",
+			q:    "from:Alice from:@bob lunch",
+			want: &msearch.Query{Text: "lunch", From: []string{"alice", "bob"}},
+		},
+		{
+			name: "in channel",
+			q:    "in:#General in:random",
+			want: &msearch.Query{Channels: []string{"general", "random"}},
+		},
+		{
+			name: "in direct messages",
+			q:    "in:@Bob",
+			want: &msearch.Query{Users: []string{"bob"}},
+		},
+		{
+			name: "before is exclusive",
+			q:    "before:2024-05-01",
+			want: &msearch.Query{Before: date("2024-05-01")},
+		},
+		{
+			name: "after is exclusive",
+			q:    "after:2024-04-30",
+			want: &msearch.Query{After: date("2024-05-01")},
+		},
+		{
+			name: "operator case of before",
+			q:    "BEFORE:2024-05-01",
+			want: &msearch.Query{Before: date("2024-05-01")},
+		},
+		{
+			name: "operator case of after",
+			q:    "After:2024-04-30",
+			want: &msearch.Query{After: date("2024-05-01")},
+		},
+		{
+			name: "has attachment",
+			q:    "has:Attachment report",
+			want: &msearch.Query{Text: "report", HasAttachment: true},
+		},
+		{
+			name: "has something else",
+			q:    "has:link",
+			want: &msearch.Query{Text: "has:link"},
+		},
+		{
+			name: "unknown operator",
+			q:    "to:alice",
+			want: &msearch.Query{Text: "to:alice"},
+		},
+		{
+			name: "empty value",
+			q:    "from: alice",
+			want: &msearch.Query{Text: "from: alice"},
+		},
+		{
+			name: "operator case",
+			q:    "FROM:alice",
+			want: &msearch.Query{From: []string{"alice"}},
+		},
+		{
+			name: "extra spaces",
+			q:    "  lunch \t\n plans ",
+			want: &msearch.Query{Text: "lunch plans"},
+		},
+		{
+			name: "unterminated quote",
+			q:    `"lunch plans`,
+			want: &msearch.Query{Text: `"lunch plans`},
+		},
+		{
+			name:    "invalid date",
+			q:       "before:yesterday",
+			wantErr: ErrInvalidDate,
+		},
+		{
+			name:    "invalid day",
+			q:       "after:2024-02-30",
+			wantErr: ErrInvalidDate,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.q)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Parse(%q) error = %v, want %v", tt.q, err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) = %+v, want %+v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	tests := []struct {
+		headline string
+		want     string
+	}{
+		{"plain", "plain"},
+		{startSel + "lunch" + stopSel + " plans", "<mark>lunch</mark> plans"},
+		{"<script>" + startSel + "alert" + stopSel + "</script>", "&lt;script&gt;<mark>alert</mark>&lt;/script&gt;"},
+		{"<mark>" + startSel + "x" + stopSel + "</mark>", "&lt;mark&gt;<mark>x</mark>&lt;/mark&gt;"},
+	}
+
+	for _, tt := range tests {
+		if got := snippet(tt.headline); got != tt.want {
+			t.Errorf("snippet of %q = %q, want %q", tt.headline, got, tt.want)
+		}
+	}
+}
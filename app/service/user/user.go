@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 
 	muser "chatbox/app/model/user"
 
@@ -37,7 +40,7 @@ func Insert(ctx context.Context, user *muser.User) (int64, error) {
 }
 
 func GetByID(ctx context.Context, id int64) (*muser.UserDetails, error) {
-	query := "SELECT id, firstname, lastname, username, emailaddress, is_active "
+	query := "SELECT id, firstname, lastname, username, emailaddress, is_active, last_seen_at "
 
 	query += "FROM users "
 
@@ -57,6 +60,7 @@ func GetByID(ctx context.Context, id int64) (*muser.UserDetails, error) {
 		&user.Username,
 		&user.EmailAddress,
 		&user.IsActive,
+		&user.LastSeenAt,
 	); err != nil {
 		return nil, err
 	}
@@ -158,7 +162,7 @@ func Fetch(ctx context.Context, filter map[string][]string, args []interface{},
 }
 
 func GetAll(ctx context.Context) ([]*muser.User, error) {
-	query := `SELECT id, firstname, lastname, username, emailaddress FROM users`
+	query := `SELECT id, firstname, lastname, username, emailaddress, last_seen_at FROM users`
 
 	rows, err := database.PostgresMain.DB.QueryContext(ctx, query)
 	if err != nil {
@@ -170,7 +174,7 @@ func GetAll(ctx context.Context) ([]*muser.User, error) {
 
 	for rows.Next() {
 		var user muser.User
-		if err := rows.Scan(&user.Id, &user.Firstname, &user.Lastname, &user.Username, &user.EmailAddress); err != nil {
+		if err := rows.Scan(&user.Id, &user.Firstname, &user.Lastname, &user.Username, &user.EmailAddress, &user.LastSeenAt); err != nil {
 			return nil, err
 		}
 		users = append(users, &user)
@@ -178,3 +182,69 @@ func GetAll(ctx context.Context) ([]*muser.User, error) {
 
 	return users, nil
 }
+
+func UpdateLastSeen(ctx context.Context, userID int64, lastSeenAt time.Time) error {
+	_, err := database.PostgresMain.DB.ExecContext(ctx, `
+		UPDATE users SET last_seen_at = $2 WHERE id = $1
+	`, userID, lastSeenAt)
+
+	return err
+}
+
+func GetLastSeen(ctx context.Context, userIDs []int64) (map[int64]time.Time, error) {
+	rows, err := database.PostgresMain.DB.QueryContext(ctx, `
+		SELECT id, last_seen_at
+		FROM users
+		WHERE id = ANY($1) AND last_seen_at IS NOT NULL
+	`, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lastSeen := make(map[int64]time.Time)
+
+	for rows.Next() {
+		var (
+			id         int64
+			lastSeenAt time.Time
+		)
+		if err := rows.Scan(&id, &lastSeenAt); err != nil {
+			return nil, err
+		}
+		lastSeen[id] = lastSeenAt
+	}
+
+	return lastSeen, rows.Err()
+}
+
+// GetContactIDs returns the users who share a channel or a direct message
+// conversation with userID.
+func GetContactIDs(ctx context.Context, userID int64) ([]int64, error) {
+	rows, err := database.PostgresMain.DB.QueryContext(ctx, `
+		SELECT other.user_id
+		FROM channel_members self
+		JOIN channel_members other ON other.channel_id = self.channel_id
+		WHERE self.user_id = $1 AND other.user_id <> $1
+		UNION
+		SELECT CASE WHEN sender_id = $1 THEN receiver_id ELSE sender_id END
+		FROM direct_messages
+		WHERE (sender_id = $1 OR receiver_id = $1) AND sender_id <> receiver_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
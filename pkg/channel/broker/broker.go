@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Kinds of hub operations carried between nodes
+const (
+	KindRoom string = "room"
+
+	KindUsers string = "users"
+
+	KindAll string = "all"
+
+	KindAdmit string = "admit"
+
+	KindKick string = "kick"
+
+	KindClose string = "close"
+)
+
+// Kinds of presence updates carried between nodes
+const (
+	// The status of the connections of a user to the publishing node
+	KindPresence string = "presence"
+
+	// Heartbeat of the publishing node
+	KindPresenceNode string = "presence.node"
+
+	// Sent by a starting node; every other node publishes its users
+	KindPresenceSync string = "presence.sync"
+)
+
+// Message is a hub operation published by one node for every other node.
+// Node identifies the publisher so that it can skip its own messages.
+type Message struct {
+	Node    string          `json:"node"`
+	Kind    string          `json:"kind"`
+	Room    string          `json:"room,omitempty"`
+	P       json.RawMessage `json:"p,omitempty"`
+	Except  int64           `json:"except,omitempty"`
+	UserID  int64           `json:"user_id,omitempty"`
+	UserIDs []int64         `json:"user_ids,omitempty"`
+}
+
+// Broker fans hub operations out to every node.
+type Broker interface {
+	// Publish sends msg to every subscriber, including the publisher.
+	Publish(ctx context.Context, msg *Message) error
+
+	// Subscribe calls handler for every published message. Handler calls
+	// are sequential.
+	Subscribe(handler func(*Message)) error
+
+	Close() error
+}
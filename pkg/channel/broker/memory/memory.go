@@ -0,0 +1,48 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"chatbox/pkg/channel/broker"
+)
+
+// Broker delivers messages to subscribers in the same process. It serves a
+// single node, or several hubs wired together in one process.
+type Broker struct {
+	handlers []func(*broker.Message)
+	mutex    sync.Mutex
+}
+
+func New() *Broker {
+	return new(Broker)
+}
+
+func (b *Broker) Publish(ctx context.Context, msg *broker.Message) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, handler := range b.handlers {
+		handler(msg)
+	}
+
+	return nil
+}
+
+func (b *Broker) Subscribe(handler func(*broker.Message)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+
+	return nil
+}
+
+func (b *Broker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.handlers = nil
+
+	return nil
+}
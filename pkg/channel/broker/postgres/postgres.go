@@ -0,0 +1,153 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+
+	"chatbox/pkg/channel/broker"
+	"chatbox/pkg/database/postgres"
+)
+
+// NOTIFY payloads must be shorter than 8000 bytes
+const maxPayload int = 7999
+
+// Stored payloads are kept long enough for every listener to read them
+const payloadRetention time.Duration = 5 * time.Minute
+
+// notification is a NOTIFY payload: the message itself, or the id of the
+// hub_broker_payloads row holding a message too large for NOTIFY.
+type notification struct {
+	broker.Message
+	Ref int64 `json:"ref,omitempty"`
+}
+
+// Broker fans messages out with LISTEN/NOTIFY. Messages are published on the
+// shared connection pool and received on a dedicated listener connection.
+// Messages too large for NOTIFY are stored and only their id is sent.
+type Broker struct {
+	db       *postgres.PostgresDB
+	channel  string
+	listener *pq.Listener
+}
+
+func New(db *postgres.PostgresDB, channel string) (*Broker, error) {
+	listener := db.NewListener(10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+
+		return nil, err
+	}
+
+	return &Broker{
+		db:       db,
+		channel:  channel,
+		listener: listener,
+	}, nil
+}
+
+func (b *Broker) Publish(ctx context.Context, msg *broker.Message) error {
+	p, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if len(p) <= maxPayload {
+		_, err = b.db.DB.ExecContext(ctx, `SELECT pg_notify($1, $2)`, b.channel, string(p))
+
+		return err
+	}
+
+	// The notification is sent on commit, once the row can be read
+	_, err = b.db.DB.ExecContext(ctx, `
+		WITH stored AS (
+			INSERT INTO hub_broker_payloads (payload) VALUES ($2) RETURNING id
+		)
+		SELECT pg_notify($1, json_build_object('ref', id)::text) FROM stored
+	`, b.channel, string(p))
+	if err != nil {
+		return err
+	}
+
+	_, err = b.db.DB.ExecContext(ctx, `
+		DELETE FROM hub_broker_payloads WHERE created_at < now() - make_interval(secs => $1)
+	`, payloadRetention.Seconds())
+
+	return err
+}
+
+// decode returns the message of a notification, reading it from
+// hub_broker_payloads when it was stored.
+func (b *Broker) decode(extra string) (*broker.Message, error) {
+	n := new(notification)
+	if err := json.Unmarshal([]byte(extra), n); err != nil {
+		return nil, err
+	}
+
+	if n.Ref == 0 {
+		return &n.Message, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var p string
+	err := b.db.DB.QueryRowContext(ctx, `SELECT payload FROM hub_broker_payloads WHERE id = $1`, n.Ref).Scan(&p)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(broker.Message)
+	if err := json.Unmarshal([]byte(p), msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (b *Broker) Subscribe(handler func(*broker.Message)) error {
+	go func() {
+		for {
+			select {
+			case n, ok := <-b.listener.Notify:
+				if !ok {
+					return
+				}
+
+				// The listener reconnected; notifications may have been lost
+				if n == nil {
+					continue
+				}
+
+				msg, err := b.decode(n.Extra)
+				if err != nil {
+					log.Print(err)
+					continue
+				}
+
+				handler(msg)
+
+			case <-time.After(90 * time.Second):
+				go func() {
+					if err := b.listener.Ping(); err != nil {
+						log.Print(err)
+					}
+				}()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *Broker) Close() error {
+	return b.listener.Close()
+}
@@ -1,9 +1,64 @@
 package channel
 
-import "chatbox/pkg/channel/hub"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"chatbox/pkg/channel/hub"
+	"chatbox/pkg/channel/presence"
+	"chatbox/pkg/channel/typing"
+)
 
 var (
-	ChatHub *hub.Hub
+	ChatHub         *hub.Hub
+	ChatTyping      *typing.Tracker
+	ChatPresence    *presence.Tracker
+	NotificationHub *hub.Hub
 	// TicketHub       *hub.Hub
-	// NotificationHub *hub.Hub
 )
+
+// ChannelRoom returns the hub room of a channel conversation.
+func ChannelRoom(channelID int64) string {
+	return fmt.Sprintf("channel:%d", channelID)
+}
+
+// DirectRoom returns the hub room shared by two users. The pair is ordered
+// so that both participants resolve to the same room.
+func DirectRoom(userID, otherID int64) string {
+	if userID > otherID {
+		userID, otherID = otherID, userID
+	}
+
+	return fmt.Sprintf("user:%d:%d", userID, otherID)
+}
+
+// ParseRoom returns the receiver class of a room and the ids in its key: the
+// channel id, or the ordered pair of a direct room.
+func ParseRoom(room string) (string, []int64, bool) {
+	parts := strings.Split(room, ":")
+
+	var class string
+
+	switch {
+	case len(parts) == 2 && parts[0] == "channel":
+		class = "channel"
+	case len(parts) == 3 && parts[0] == "user":
+		class = "user"
+	default:
+		return "", nil, false
+	}
+
+	ids := make([]int64, 0, len(parts)-1)
+
+	for _, part := range parts[1:] {
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return "", nil, false
+		}
+
+		ids = append(ids, id)
+	}
+
+	return class, ids, true
+}
@@ -0,0 +1,171 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Version is the envelope version negotiated through the ?v= query gate.
+const Version string = "1.0"
+
+// Client to server
+const (
+	TypeMessageSend string = "message.send"
+
+	TypeMessageEdit string = "message.edit"
+
+	TypeTypingStart string = "typing.start"
+
+	TypeTypingStop string = "typing.stop"
+
+	TypeRead string = "read"
+
+	TypePresence string = "presence"
+
+	TypeAuth string = "auth"
+
+	TypeSubscribe string = "subscribe"
+
+	TypeUnsubscribe string = "unsubscribe"
+)
+
+// Server to client
+const (
+	TypeMessageCreated string = "message.created"
+
+	TypeMessageEdited string = "message.edited"
+
+	TypeMessageDeleted string = "message.deleted"
+
+	TypeThreadUpdated string = "thread.updated"
+
+	TypeReactionAdded string = "reaction.added"
+
+	TypeReactionRemoved string = "reaction.removed"
+
+	TypeReadUpdated string = "read.updated"
+
+	TypeAttachmentUpdated string = "attachment.updated"
+
+	TypePresenceChanged string = "presence.changed"
+
+	TypeNotificationMessage string = "notification.message"
+
+	TypeNotificationMention string = "notification.mention"
+
+	TypeNotificationInvite string = "notification.invite"
+
+	TypeNotificationMembership string = "notification.membership"
+
+	TypeNotificationSystem string = "notification.system"
+
+	TypeReplayCompleted string = "replay.completed"
+
+	// Last event of a Server-Sent Events stream the server ends
+	TypeClose string = "close"
+
+	TypeAck string = "ack"
+
+	TypeError string = "error"
+)
+
+// Error codes
+const (
+	ErrorMalformed string = "malformed"
+
+	ErrorUnsupportedVersion string = "unsupported_version"
+
+	ErrorUnsupportedType string = "unsupported_type"
+
+	ErrorInvalid string = "invalid"
+
+	ErrorUnauthorized string = "unauthorized"
+
+	ErrorForbidden string = "forbidden"
+
+	ErrorInternal string = "internal"
+
+	ErrorRateLimited string = "rate_limited"
+
+	ErrorTooLarge string = "too_large"
+
+	ErrorMuted string = "muted"
+)
+
+var (
+	ErrMissingType = errors.New("event: missing type")
+
+	ErrVersionMismatch = errors.New("event: version mismatch")
+)
+
+// Envelope wraps every frame sent over the websocket API.
+type Envelope struct {
+	V        string          `json:"v"`
+	Type     string          `json:"type"`
+	Room     string          `json:"room,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	ClientID string          `json:"client_id,omitempty"`
+	AckID    string          `json:"ack_id,omitempty"`
+}
+
+// Error is the payload of an error event.
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Parse decodes a client frame and checks its version and type.
+func Parse(p []byte) (*Envelope, error) {
+	env := new(Envelope)
+
+	if err := json.Unmarshal(p, env); err != nil {
+		return nil, err
+	}
+
+	if env.V != Version {
+		return env, ErrVersionMismatch
+	}
+
+	if env.Type == "" {
+		return env, ErrMissingType
+	}
+
+	return env, nil
+}
+
+// Decode unmarshals the envelope payload into v.
+func (e *Envelope) Decode(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return errors.New("event: missing payload")
+	}
+
+	return json.Unmarshal(e.Payload, v)
+}
+
+// New encodes an event of the given type for room.
+func New(typ, room string, payload interface{}) ([]byte, error) {
+	return Reply(typ, room, payload, "", "")
+}
+
+// Reply encodes an event that echoes the correlation ids of a client frame.
+func Reply(typ, room string, payload interface{}, clientID, ackID string) ([]byte, error) {
+	env := &Envelope{
+		V:        Version,
+		Type:     typ,
+		Room:     room,
+		ClientID: clientID,
+		AckID:    ackID,
+	}
+
+	if payload != nil {
+		p, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		env.Payload = p
+	}
+
+	return json.Marshal(env)
+}
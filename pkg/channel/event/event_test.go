@@ -0,0 +1,179 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   string
+		want    *Envelope
+		wantErr error
+	}{
+		{
+			name:  "message",
+			frame: `{"v":"1.0","type":"message.send","payload":{"message":"hi"},"client_id":"c1"}`,
+			want:  &Envelope{V: Version, Type: TypeMessageSend, Payload: json.RawMessage(`{"message":"hi"}`), ClientID: "c1"},
+		},
+		{
+			name:  "without payload",
+			frame: `{"v":"1.0","type":"typing.start","ack_id":"a1"}`,
+			want:  &Envelope{V: Version, Type: TypeTypingStart, AckID: "a1"},
+		},
+		{
+			name:    "old version",
+			frame:   `{"v":"0.9","type":"message.send"}`,
+			want:    &Envelope{V: "0.9", Type: TypeMessageSend},
+			wantErr: ErrVersionMismatch,
+		},
+		{
+			name:    "missing version",
+			frame:   `{"type":"message.send"}`,
+			want:    &Envelope{Type: TypeMessageSend},
+			wantErr: ErrVersionMismatch,
+		},
+		{
+			name:    "missing type",
+			frame:   `{"v":"1.0"}`,
+			want:    &Envelope{V: Version},
+			wantErr: ErrMissingType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.frame))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, frame := range []string{``, `hello`, `{"v":1}`, `[]`} {
+		if _, err := Parse([]byte(frame)); err == nil {
+			t.Errorf("Parse(%q) succeeded", frame)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      string
+		room     string
+		payload  interface{}
+		clientID string
+		ackID    string
+		want     string
+	}{
+		{
+			name:    "event",
+			typ:     TypeMessageCreated,
+			room:    "channel:3",
+			payload: map[string]int{"id": 42},
+			want:    `{"v":"1.0","type":"message.created","room":"channel:3","payload":{"id":42}}`,
+		},
+		{
+			name:     "reply",
+			typ:      TypeAck,
+			payload:  nil,
+			clientID: "c1",
+			ackID:    "a1",
+			want:     `{"v":"1.0","type":"ack","client_id":"c1","ack_id":"a1"}`,
+		},
+		{
+			name:    "error",
+			typ:     TypeError,
+			payload: Error{Code: ErrorRateLimited, Message: "slow down"},
+			want:    `{"v":"1.0","type":"error","payload":{"code":"rate_limited","message":"slow down"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Reply(tt.typ, tt.room, tt.payload, tt.clientID, tt.ackID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("Reply() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplyUnencodable(t *testing.T) {
+	if _, err := New(TypeMessageCreated, "", make(chan int)); err == nil {
+		t.Error("New() succeeded with an unencodable payload")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	type message struct {
+		ID      int64  `json:"id"`
+		Message string `json:"message"`
+	}
+
+	in := message{ID: 42, Message: "kamusta?"}
+
+	p, err := New(TypeMessageCreated, "user:1:2", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := Parse(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if env.Type != TypeMessageCreated || env.Room != "user:1:2" {
+		t.Errorf("Parse() = %+v", env)
+	}
+
+	var out message
+	if err := env.Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out != in {
+		t.Errorf("Decode() = %+v, want %+v", out, in)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		wantErr bool
+	}{
+		{"object", `{"message":"hi"}`, false},
+		{"missing", ``, true},
+		{"wrong type", `"hi"`, true},
+		{"malformed", `{"message":`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Envelope{V: Version, Type: TypeMessageSend, Payload: json.RawMessage(tt.payload)}
+
+			var v struct {
+				Message string `json:"message"`
+			}
+
+			if err := env.Decode(&v); (err != nil) != tt.wantErr {
+				t.Errorf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"chatbox/pkg/settings"
+)
+
+// Client is a single connection registered with a hub. Every
+// client owns a bounded outbound queue drained by its own writer goroutine,
+// so a slow peer only ever blocks itself.
+type Client struct {
+	conn   Transport
+	userID int64
+	lobby  bool
+	rooms  map[string]struct{}
+	send   chan []byte
+	quit   chan struct{}
+	done   chan struct{}
+
+	// While holding, frames are parked in held instead of the queue
+	holding bool
+	held    [][]byte
+	mutex   sync.Mutex
+
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+
+	// Set when the queued frames are written before closing
+	drain bool
+}
+
+func newClient(conn Transport, userID int64) *Client {
+	client := new(Client)
+
+	client.conn = conn
+
+	client.userID = userID
+
+	client.rooms = make(map[string]struct{})
+
+	client.send = make(chan []byte, settings.WebSocketSendBufferSize)
+
+	client.quit = make(chan struct{})
+
+	client.done = make(chan struct{})
+
+	return client
+}
+
+// Conn returns the transport of the client.
+func (c *Client) Conn() Transport {
+	return c.conn
+}
+
+// Done is closed once the writer of the client has stopped.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// UserID returns the authenticated user the connection belongs to.
+func (c *Client) UserID() int64 {
+	return c.userID
+}
+
+// Send queues p for this client only. It reports false when the outbound
+// buffer is full.
+func (c *Client) Send(p []byte) bool {
+	return c.enqueue(p)
+}
+
+// enqueue queues p for the writer without blocking. It reports false when
+// the outbound buffer, or the held backlog, is full.
+func (c *Client) enqueue(p []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.holding {
+		if len(c.held) >= settings.WebSocketHeldLimit {
+			return false
+		}
+
+		c.held = append(c.held, p)
+
+		return true
+	}
+
+	select {
+	case c.send <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// Resume writes frames ahead of everything delivered since the client was
+// registered held, then releases the held frames, dropping those for which
+// skip reports true, and switches to live delivery. It blocks until every
+// frame is queued and reports false if the client closed meanwhile.
+func (c *Client) Resume(frames [][]byte, skip func(p []byte) bool) bool {
+	for _, p := range frames {
+		if !c.push(p) {
+			return false
+		}
+	}
+
+	for {
+		c.mutex.Lock()
+
+		held := c.held
+
+		c.held = nil
+
+		if len(held) == 0 {
+			c.holding = false
+
+			c.mutex.Unlock()
+
+			return true
+		}
+
+		c.mutex.Unlock()
+
+		for _, p := range held {
+			if skip != nil && skip(p) {
+				continue
+			}
+
+			if !c.push(p) {
+				return false
+			}
+		}
+	}
+}
+
+// push queues p, waiting for room in the queue.
+func (c *Client) push(p []byte) bool {
+	select {
+	case c.send <- p:
+		return true
+	case <-c.quit:
+		return false
+	case <-c.done:
+		return false
+	}
+}
+
+// Close sends a close frame with code and text to the peer and tears the
+// connection down. The read loop of the connection then fails, and the
+// client must still be unregistered.
+func (c *Client) Close(code int, text string) {
+	c.close(code, text)
+}
+
+// close stops the writer. A non-zero code is sent to the peer as a close
+// frame before the connection is torn down.
+func (c *Client) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeText = code, text
+
+		close(c.quit)
+	})
+}
+
+// drainClose stops the writer once the frames already queued are written.
+// Held frames are dropped: they belong after a replay that is cut short, and
+// are replayed again once the client resumes from the last frame it got.
+func (c *Client) drainClose(code int, text string) {
+	c.mutex.Lock()
+	c.held = nil
+	c.mutex.Unlock()
+
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeText, c.drain = code, text, true
+
+		close(c.quit)
+	})
+}
+
+// flush writes the frames still queued, without waiting for new ones.
+func (c *Client) flush() {
+	for {
+		select {
+		case p := <-c.send:
+			if err := c.conn.WriteFrame(p); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(settings.WebSocketPingInterval)
+
+	defer func() {
+		ticker.Stop()
+
+		close(c.done)
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.conn.Ping(); err != nil {
+				c.conn.Close(0, "")
+
+				return
+			}
+
+		case p := <-c.send:
+			if err := c.conn.WriteFrame(p); err != nil {
+				c.conn.Close(0, "")
+
+				return
+			}
+
+		case <-c.quit:
+			if c.drain {
+				c.flush()
+			}
+
+			if c.closeCode != 0 {
+				c.conn.Close(c.closeCode, c.closeText)
+			}
+
+			return
+		}
+	}
+}
@@ -1,37 +1,125 @@
 package hub
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gofiber/contrib/websocket"
+
+	"chatbox/pkg/channel/broker"
+	"chatbox/pkg/settings"
+)
+
+// Application close codes sent to clients removed by the hub.
+const (
+	CloseTokenExpired int = 4001
+
+	CloseMembershipRevoked int = 4003
+
+	CloseRoomDeleted int = 4004
+
+	CloseIdleTimeout int = 4008
+)
+
+// Violation is a kind of client misbehaviour counted in the hub metrics.
+type Violation int
+
+const (
+	ViolationRate Violation = iota
+
+	ViolationSize
+
+	ViolationMute
 )
 
+// Metrics is a snapshot of the hub counters.
+type Metrics struct {
+	Rooms       int    `json:"rooms"`
+	Connections int    `json:"connections"`
+	Evicted     uint64 `json:"evicted"`
+	RateLimited uint64 `json:"rate_limited"`
+	Oversized   uint64 `json:"oversized"`
+	Muted       uint64 `json:"muted"`
+}
+
 type Message struct {
-	Id string
-	P  []byte
+	Id      string
+	P       []byte
+	Except  int64
+	UserIDs []int64
+}
+
+type subscription struct {
+	client *Client
+	room   string
+	leave  bool
+	done   chan struct{}
+}
+
+type shutdown struct {
+	code    int
+	text    string
+	clients chan []*Client
+}
+
+type membership struct {
+	room   string
+	userID int64
+	admit  bool
+	all    bool
 }
 
 type Hub struct {
-	clients      map[*websocket.Conn]bool
+	clients      map[*Client]bool
+	rooms        map[string]map[*Client]struct{}
+	users        map[int64]map[*Client]struct{}
 	broadcast    chan *Message
 	broadcastall chan *Message
-	register     chan *websocket.Conn
-	unregister   chan *websocket.Conn
+	register     chan *subscription
+	subscription chan *subscription
+	unregister   chan *Client
+	membership   chan *membership
+	shutdown     chan *shutdown
+	onRegister   func(*Client)
+	onUnregister func(*Client)
+	broker       broker.Broker
+	node         string
 	mutex        sync.RWMutex
+
+	evicted     atomic.Uint64
+	rateLimited atomic.Uint64
+	oversized   atomic.Uint64
+	muted       atomic.Uint64
+
+	// Once closing, new clients are closed with closeCode right away
+	closing   atomic.Bool
+	closeCode int
+	closeText string
 }
 
 func New() *Hub {
 	hub := new(Hub)
 
-	hub.clients = make(map[*websocket.Conn]bool)
+	hub.clients = make(map[*Client]bool)
+
+	hub.rooms = make(map[string]map[*Client]struct{})
+
+	hub.users = make(map[int64]map[*Client]struct{})
 
 	hub.broadcast = make(chan *Message)
 
 	hub.broadcastall = make(chan *Message)
 
-	hub.register = make(chan *websocket.Conn)
+	hub.register = make(chan *subscription)
+
+	hub.subscription = make(chan *subscription)
 
-	hub.unregister = make(chan *websocket.Conn)
+	hub.unregister = make(chan *Client)
+
+	hub.membership = make(chan *membership)
+
+	hub.shutdown = make(chan *shutdown)
 
 	return hub
 }
@@ -39,69 +127,504 @@ func New() *Hub {
 func (h *Hub) Run() {
 	for {
 		select {
-		case conn := <-h.register:
+		case sub := <-h.register:
+			if h.closing.Load() {
+				sub.client.close(h.closeCode, h.closeText)
+
+				continue
+			}
+
 			h.mutex.Lock()
 
-			h.clients[conn] = true
+			h.add(sub.client)
+
+			if sub.room != "" {
+				h.join(sub.client, sub.room)
+			}
 
 			h.mutex.Unlock()
 
-		case conn := <-h.unregister:
+		case sub := <-h.subscription:
 			h.mutex.Lock()
 
-			if _, ok := h.clients[conn]; ok {
-				delete(h.clients, conn)
-
-				conn.Close()
+			// Clients removed meanwhile stay out of every room
+			if _, ok := h.clients[sub.client]; ok {
+				if sub.leave {
+					h.leave(sub.client, sub.room)
+				} else {
+					h.join(sub.client, sub.room)
+				}
 			}
 
 			h.mutex.Unlock()
 
-		case message := <-h.broadcast:
+			close(sub.done)
+
+		case client := <-h.unregister:
+			h.mutex.Lock()
+
+			h.remove(client)
+
+			h.mutex.Unlock()
+
+			client.close(0, "")
+
+		case req := <-h.shutdown:
+			h.closeCode, h.closeText = req.code, req.text
+
+			h.closing.Store(true)
+
 			h.mutex.RLock()
 
+			clients := make([]*Client, 0, len(h.clients))
 			for client := range h.clients {
-				if message.Id != "" && message.Id == client.Params("id") {
-					if err := client.WriteMessage(websocket.TextMessage, message.P); err != nil {
-						delete(h.clients, client)
+				clients = append(clients, client)
+			}
+
+			h.mutex.RUnlock()
+
+			// Broadcasts handed to the hub before are already queued, so
+			// draining the queues delivers them before the close frame
+			for _, client := range clients {
+				client.drainClose(req.code, req.text)
+			}
+
+			req.clients <- clients
+
+		case change := <-h.membership:
+			switch {
+			case change.all:
+				h.closeRoom(change.room)
+			case change.admit:
+				h.admit(change.room, change.userID)
+			default:
+				h.kick(change.room, change.userID)
+			}
+
+		case message := <-h.broadcast:
+			if message.UserIDs != nil {
+				set := make(map[*Client]struct{})
 
-						client.Close()
+				for _, userID := range message.UserIDs {
+					for client := range h.users[userID] {
+						set[client] = struct{}{}
 					}
 				}
+
+				h.deliver(set, message.P, message.Except)
+
+				continue
 			}
 
-			h.mutex.RUnlock()
+			h.deliver(h.rooms[message.Id], message.P, message.Except)
 
 		case message := <-h.broadcastall:
-			h.mutex.RLock()
+			lobby := make(map[*Client]struct{})
 
 			for client := range h.clients {
-				if client.Params("id") == "" {
-					if err := client.WriteMessage(websocket.TextMessage, message.P); err != nil {
-						delete(h.clients, client)
-
-						client.Close()
-					}
+				if client.lobby {
+					lobby[client] = struct{}{}
 				}
 			}
 
-			h.mutex.RUnlock()
+			h.deliver(lobby, message.P, 0)
+		}
+	}
+}
+
+// deliver queues p on every client in set except those of the user except.
+// Clients whose buffer is full are evicted instead of stalling the rest of
+// the room.
+func (h *Hub) deliver(set map[*Client]struct{}, p []byte, except int64) {
+	var slow []*Client
+
+	for client := range set {
+		if except != 0 && client.userID == except {
+			continue
+		}
+
+		if !client.enqueue(p) {
+			slow = append(slow, client)
+		}
+	}
+
+	if len(slow) == 0 {
+		return
+	}
+
+	h.mutex.Lock()
+
+	for _, client := range slow {
+		h.remove(client)
+	}
+
+	h.mutex.Unlock()
+
+	h.evicted.Add(uint64(len(slow)))
+
+	for _, client := range slow {
+		client.close(websocket.ClosePolicyViolation, "slow consumer")
+	}
+}
+
+// admit subscribes the lobby clients of userID to room.
+func (h *Hub) admit(room string, userID int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for client := range h.users[userID] {
+		if client.lobby {
+			h.join(client, room)
+		}
+	}
+}
+
+// kick unsubscribes the clients of userID from room. Clients that were opened
+// for that room alone are closed.
+func (h *Hub) kick(room string, userID int64) {
+	var closed []*Client
+
+	h.mutex.Lock()
+
+	for client := range h.rooms[room] {
+		if client.userID != userID {
+			continue
+		}
+
+		h.leave(client, room)
+
+		if !client.lobby && len(client.rooms) == 0 {
+			h.remove(client)
+
+			closed = append(closed, client)
+		}
+	}
+
+	h.mutex.Unlock()
+
+	for _, client := range closed {
+		client.close(CloseMembershipRevoked, "membership revoked")
+	}
+}
+
+// closeRoom unsubscribes every client from room.
+func (h *Hub) closeRoom(room string) {
+	var closed []*Client
+
+	h.mutex.Lock()
+
+	for client := range h.rooms[room] {
+		h.leave(client, room)
+
+		if !client.lobby && len(client.rooms) == 0 {
+			h.remove(client)
+
+			closed = append(closed, client)
+		}
+	}
+
+	h.mutex.Unlock()
+
+	for _, client := range closed {
+		client.close(CloseRoomDeleted, "room deleted")
+	}
+}
+
+// add, remove, join and leave must be called with the write lock held.
+func (h *Hub) add(client *Client) {
+	h.clients[client] = true
+
+	if _, ok := h.users[client.userID]; !ok {
+		h.users[client.userID] = make(map[*Client]struct{})
+	}
+
+	h.users[client.userID][client] = struct{}{}
+
+	if h.onRegister != nil {
+		h.onRegister(client)
+	}
+}
+
+func (h *Hub) remove(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+
+	delete(h.clients, client)
+
+	delete(h.users[client.userID], client)
+
+	if len(h.users[client.userID]) == 0 {
+		delete(h.users, client.userID)
+	}
+
+	for room := range client.rooms {
+		h.leave(client, room)
+	}
+
+	if h.onUnregister != nil {
+		h.onUnregister(client)
+	}
+}
+
+func (h *Hub) join(client *Client, room string) {
+	if _, ok := h.rooms[room]; !ok {
+		h.rooms[room] = make(map[*Client]struct{})
+	}
+
+	h.rooms[room][client] = struct{}{}
+
+	client.rooms[room] = struct{}{}
+}
+
+func (h *Hub) leave(client *Client, room string) {
+	delete(h.rooms[room], client)
+
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+
+	delete(client.rooms, room)
+}
+
+// Hooks sets functions called whenever a client is added to or removed from
+// the hub, including evictions. They run on the hub goroutine and must not
+// call back into the hub. Hooks must be set before Run.
+func (h *Hub) Hooks(register, unregister func(*Client)) {
+	h.onRegister, h.onUnregister = register, unregister
+}
+
+// Register adds conn for userID to the hub, subscribed to room, and starts
+// its writer. An empty room registers a lobby client that receives
+// BroadcastAll and is subscribed to rooms as userID is admitted to them.
+func (h *Hub) Register(conn Transport, userID int64, room string) *Client {
+	client := newClient(conn, userID)
+
+	client.lobby = room == ""
+
+	go client.writePump()
+
+	h.register <- &subscription{client: client, room: room}
+
+	return client
+}
+
+// RegisterHeld registers like Register, but holds back every frame delivered
+// to the client until Resume is called on it.
+func (h *Hub) RegisterHeld(conn Transport, userID int64, room string) *Client {
+	client := newClient(conn, userID)
+
+	client.lobby = room == ""
+
+	client.holding = true
+
+	go client.writePump()
+
+	h.register <- &subscription{client: client, room: room}
+
+	return client
+}
+
+// Unregister removes client from every room and waits for its writer to
+// stop, so the connection can be released safely afterwards.
+func (h *Hub) Unregister(client *Client) {
+	h.unregister <- client
+
+	<-client.done
+}
+
+// Subscribe adds a registered client to room and returns once it receives
+// the events of room. Unlike Admit it only affects this client and is not
+// published to other nodes.
+func (h *Hub) Subscribe(client *Client, room string) {
+	sub := &subscription{client: client, room: room, done: make(chan struct{})}
+
+	h.subscription <- sub
+
+	<-sub.done
+}
+
+// Unsubscribe removes client from room, leaving it registered.
+func (h *Hub) Unsubscribe(client *Client, room string) {
+	sub := &subscription{client: client, room: room, leave: true, done: make(chan struct{})}
+
+	h.subscription <- sub
+
+	<-sub.done
+}
+
+// Subscribed reports whether client currently receives the events of room.
+func (h *Hub) Subscribed(client *Client, room string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	_, ok := h.rooms[room][client]
+
+	return ok
+}
+
+// Subscriptions returns the number of rooms client is subscribed to.
+func (h *Hub) Subscriptions(client *Client) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return len(client.rooms)
+}
+
+// Bridge connects the hub to other nodes through b. Every operation is
+// applied locally and published; operations published by node itself are
+// skipped on receipt. Bridge must be called before Run.
+func (h *Hub) Bridge(b broker.Broker, node string) error {
+	h.broker, h.node = b, node
+
+	return b.Subscribe(func(msg *broker.Message) {
+		if msg.Node == h.node {
+			return
 		}
+
+		h.apply(msg)
+	})
+}
+
+// apply performs msg on the local connections.
+func (h *Hub) apply(msg *broker.Message) {
+	switch msg.Kind {
+	case broker.KindRoom:
+		h.broadcast <- &Message{Id: msg.Room, P: msg.P, Except: msg.Except}
+	case broker.KindUsers:
+		h.broadcast <- &Message{P: msg.P, UserIDs: msg.UserIDs}
+	case broker.KindAll:
+		h.broadcastall <- &Message{P: msg.P}
+	case broker.KindAdmit:
+		h.membership <- &membership{room: msg.Room, userID: msg.UserID, admit: true}
+	case broker.KindKick:
+		h.membership <- &membership{room: msg.Room, userID: msg.UserID}
+	case broker.KindClose:
+		h.membership <- &membership{room: msg.Room, all: true}
 	}
 }
 
-func (h *Hub) Register(conn *websocket.Conn) {
-	h.register <- conn
+// publish applies msg locally and hands it to the broker, if any. The error
+// means the other nodes were not reached; the local connections always are.
+func (h *Hub) publish(msg *broker.Message) error {
+	h.apply(msg)
+
+	if h.broker == nil {
+		return nil
+	}
+
+	msg.Node = h.node
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	return h.broker.Publish(ctx, msg)
 }
 
-func (h *Hub) Unregister(conn *websocket.Conn) {
-	h.unregister <- conn
+// Admit subscribes the live lobby connections of userID to room.
+func (h *Hub) Admit(room string, userID int64) error {
+	return h.publish(&broker.Message{Kind: broker.KindAdmit, Room: room, UserID: userID})
 }
 
-func (h *Hub) Broadcast(id string, p []byte) {
-	h.broadcast <- &Message{Id: id, P: p}
+// Kick removes the live connections of userID from room.
+func (h *Hub) Kick(room string, userID int64) error {
+	return h.publish(&broker.Message{Kind: broker.KindKick, Room: room, UserID: userID})
 }
 
-func (h *Hub) BroadcastAll(p []byte) {
-	h.broadcastall <- &Message{P: p}
+// CloseRoom removes every live connection from room.
+func (h *Hub) CloseRoom(room string) error {
+	return h.publish(&broker.Message{Kind: broker.KindClose, Room: room})
+}
+
+func (h *Hub) Broadcast(id string, p []byte) error {
+	return h.publish(&broker.Message{Kind: broker.KindRoom, Room: id, P: p})
+}
+
+// BroadcastExcept sends p to room, skipping every connection of userID.
+func (h *Hub) BroadcastExcept(id string, p []byte, userID int64) error {
+	return h.publish(&broker.Message{Kind: broker.KindRoom, Room: id, P: p, Except: userID})
+}
+
+// BroadcastUsers sends p to every connection of the given users, whatever
+// room they are subscribed to.
+func (h *Hub) BroadcastUsers(userIDs []int64, p []byte) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	return h.publish(&broker.Message{Kind: broker.KindUsers, P: p, UserIDs: userIDs})
+}
+
+func (h *Hub) BroadcastAll(p []byte) error {
+	return h.publish(&broker.Message{Kind: broker.KindAll, P: p})
+}
+
+// Shutdown closes every client with code and text once its queued frames are
+// written, and closes clients registered afterwards right away. The frames
+// held for a client that is still resuming are dropped. It waits for
+// the writers to stop until ctx is done. Clients must still be unregistered
+// by their handlers.
+func (h *Hub) Shutdown(ctx context.Context, code int, text string) error {
+	req := &shutdown{code: code, text: text, clients: make(chan []*Client, 1)}
+
+	select {
+	case h.shutdown <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, client := range <-req.clients {
+		select {
+		case <-client.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Closing reports whether Shutdown was called.
+func (h *Hub) Closing() bool {
+	return h.closing.Load()
+}
+
+// Rooms returns the number of rooms with at least one subscriber.
+func (h *Hub) Rooms() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return len(h.rooms)
+}
+
+// Connections returns the number of registered clients.
+func (h *Hub) Connections() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return len(h.clients)
+}
+
+// Count records a limit violation by one of the hub clients.
+func (h *Hub) Count(v Violation) {
+	switch v {
+	case ViolationRate:
+		h.rateLimited.Add(1)
+	case ViolationSize:
+		h.oversized.Add(1)
+	case ViolationMute:
+		h.muted.Add(1)
+	}
+}
+
+// Metrics returns the current hub counters.
+func (h *Hub) Metrics() Metrics {
+	return Metrics{
+		Rooms:       h.Rooms(),
+		Connections: h.Connections(),
+		Evicted:     h.evicted.Load(),
+		RateLimited: h.rateLimited.Load(),
+		Oversized:   h.oversized.Load(),
+		Muted:       h.muted.Load(),
+	}
 }
@@ -0,0 +1,281 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+
+	"chatbox/pkg/settings"
+)
+
+// conn is a Transport recording what the writer of a client sends. Writes
+// wait while it is blocked.
+type conn struct {
+	mutex     sync.Mutex
+	frames    []string
+	closed    bool
+	closeCode int
+	blocked   chan struct{}
+}
+
+func newConn() *conn {
+	return new(conn)
+}
+
+// block makes writes wait until the returned function is called.
+func (c *conn) block() func() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.blocked = make(chan struct{})
+
+	return func() { close(c.blocked) }
+}
+
+func (c *conn) WriteFrame(p []byte) error {
+	c.mutex.Lock()
+	blocked := c.blocked
+	c.mutex.Unlock()
+
+	if blocked != nil {
+		<-blocked
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.frames = append(c.frames, string(p))
+
+	return nil
+}
+
+func (c *conn) Ping() error {
+	return nil
+}
+
+func (c *conn) Close(code int, text string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed, c.closeCode = true, code
+
+	return nil
+}
+
+// wait returns the frames written once there are n of them.
+func (c *conn) wait(t *testing.T, n int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		c.mutex.Lock()
+		frames := append([]string{}, c.frames...)
+		c.mutex.Unlock()
+
+		if len(frames) >= n {
+			return frames
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d frames %v, want %d", len(frames), frames, n)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitClosed returns the close code once the transport is closed.
+func (c *conn) waitClosed(t *testing.T) int {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		c.mutex.Lock()
+		closed, code := c.closed, c.closeCode
+		c.mutex.Unlock()
+
+		if closed {
+			return code
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("transport not closed")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func run(t *testing.T) *Hub {
+	t.Helper()
+
+	h := New()
+
+	go h.Run()
+
+	return h
+}
+
+func TestBroadcastRooms(t *testing.T) {
+	h := run(t)
+
+	alice, bob, lobby := newConn(), newConn(), newConn()
+
+	h.Register(alice, 1, "room:a")
+	h.Register(bob, 2, "room:b")
+	h.Register(lobby, 1, "")
+
+	h.Broadcast("room:a", []byte("to a"))
+	h.BroadcastExcept("room:a", []byte("to a but 1"), 1)
+	h.BroadcastUsers([]int64{2}, []byte("to 2"))
+	h.BroadcastAll([]byte("to lobbies"))
+	h.Broadcast("room:b", []byte("to b"))
+
+	// Broadcasts are delivered in order, so the last ones show the others
+	// have been too
+	if got, want := bob.wait(t, 2), []string{"to 2", "to b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bob got %v, want %v", got, want)
+	}
+
+	h.Broadcast("room:a", []byte("last"))
+
+	if got, want := alice.wait(t, 2), []string{"to a", "last"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alice got %v, want %v", got, want)
+	}
+
+	if got, want := lobby.wait(t, 1), []string{"to lobbies"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lobby got %v, want %v", got, want)
+	}
+}
+
+func TestEvictSlowClient(t *testing.T) {
+	h := run(t)
+
+	slow, fast := newConn(), newConn()
+
+	unblock := slow.block()
+
+	h.Register(slow, 1, "room")
+	h.Register(fast, 2, "room")
+
+	// One frame is taken by the blocked writer, the queue holds the rest
+	n := settings.WebSocketSendBufferSize + 2
+
+	for i := range n {
+		h.Broadcast("room", []byte(fmt.Sprint(i)))
+	}
+
+	if got := fast.wait(t, n); len(got) != n {
+		t.Errorf("fast client got %d frames, want %d", len(got), n)
+	}
+
+	if got := h.Metrics().Evicted; got != 1 {
+		t.Errorf("Evicted = %d, want 1", got)
+	}
+
+	if got := h.Connections(); got != 1 {
+		t.Errorf("Connections() = %d, want 1", got)
+	}
+
+	unblock()
+
+	if code := slow.waitClosed(t); code != websocket.ClosePolicyViolation {
+		t.Errorf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestResumeOrder(t *testing.T) {
+	h := run(t)
+
+	c := newConn()
+
+	client := h.RegisterHeld(c, 1, "room")
+
+	for _, p := range []string{"live 1", "replayed", "live 2"} {
+		h.Broadcast("room", []byte(p))
+	}
+
+	// The last broadcast is held once the hub takes the next one
+	h.Broadcast("other", nil)
+
+	ok := client.Resume([][]byte{[]byte("replay 1"), []byte("replayed")}, func(p []byte) bool {
+		return string(p) == "replayed"
+	})
+	if !ok {
+		t.Fatal("Resume() = false")
+	}
+
+	h.Broadcast("room", []byte("live 3"))
+
+	want := []string{"replay 1", "replayed", "live 1", "live 2", "live 3"}
+
+	if got := c.wait(t, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("frames = %v, want %v", got, want)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	h := run(t)
+
+	live, held := newConn(), newConn()
+
+	unblock := live.block()
+
+	h.Register(live, 1, "room")
+	h.RegisterHeld(held, 2, "room")
+
+	h.Broadcast("room", []byte("1"))
+	h.Broadcast("room", []byte("2"))
+
+	// The frames are queued before the shutdown, and written once the
+	// writer is free again
+	done := make(chan error, 1)
+
+	go func() {
+		done <- h.Shutdown(context.Background(), websocket.CloseGoingAway, "bye")
+	}()
+
+	for !h.Closing() {
+		time.Sleep(time.Millisecond)
+	}
+
+	unblock()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := live.wait(t, 2), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("live client got %v, want %v", got, want)
+	}
+
+	for name, c := range map[string]*conn{"live": live, "held": held} {
+		if code := c.waitClosed(t); code != websocket.CloseGoingAway {
+			t.Errorf("%s client closed with %d, want %d", name, code, websocket.CloseGoingAway)
+		}
+	}
+
+	// Frames held for a replay that never finished are dropped
+	if got := held.wait(t, 0); len(got) != 0 {
+		t.Errorf("held client got %v, want nothing", got)
+	}
+
+	if !h.Closing() {
+		t.Error("Closing() = false after Shutdown")
+	}
+
+	late := newConn()
+
+	h.Register(late, 3, "room")
+
+	if code := late.waitClosed(t); code != websocket.CloseGoingAway {
+		t.Errorf("client registered after Shutdown closed with %d, want %d", code, websocket.CloseGoingAway)
+	}
+}
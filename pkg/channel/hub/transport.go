@@ -0,0 +1,55 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+
+	"chatbox/pkg/settings"
+)
+
+// Transport carries the frames of a client to its peer. Its methods are only
+// called from the writer goroutine of the client.
+type Transport interface {
+	// WriteFrame writes a single event frame.
+	WriteFrame(p []byte) error
+
+	// Ping keeps the connection alive and fails once the peer is gone.
+	Ping() error
+
+	// Close tears the connection down, telling the peer why first when code
+	// is non-zero.
+	Close(code int, text string) error
+}
+
+// socket is the websocket transport.
+type socket struct {
+	conn *websocket.Conn
+}
+
+// WebSocket returns a transport writing to conn.
+func WebSocket(conn *websocket.Conn) Transport {
+	return &socket{conn: conn}
+}
+
+func (s *socket) WriteFrame(p []byte) error {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(settings.WebSocketWriteWait))
+
+	return s.conn.WriteMessage(websocket.TextMessage, p)
+}
+
+func (s *socket) Ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(settings.WebSocketWriteWait))
+}
+
+func (s *socket) Close(code int, text string) error {
+	if code != 0 {
+		_ = s.conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, text),
+			time.Now().Add(settings.WebSocketWriteWait),
+		)
+	}
+
+	return s.conn.Close()
+}
@@ -0,0 +1,436 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"chatbox/pkg/channel/broker"
+)
+
+const (
+	StatusOnline string = "online"
+
+	StatusIdle string = "idle"
+
+	StatusOffline string = "offline"
+)
+
+// Time allowed to publish a presence update to the other nodes
+const publishTimeout time.Duration = 10 * time.Second
+
+type Presence struct {
+	UserID     int64      `json:"user_id"`
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+}
+
+type connection struct {
+	activeAt time.Time
+	idle     bool
+}
+
+type user struct {
+	conns map[interface{}]*connection
+	// Status of the connections to this node, as last published
+	local string
+	// Status on other nodes, by node; offline nodes are left out
+	remote     map[string]*Presence
+	status     string
+	lastSeenAt time.Time
+}
+
+// Tracker aggregates the connections of every user, across tabs and
+// devices, into a single online, idle or offline status. A user is online
+// while any connection is active, idle once every connection has been
+// inactive for the idle timeout, and offline when the last one goes away.
+// Once bridged, the connections to every node count, and each change is
+// reported by a single node: the one whose connections made it, or for the
+// users of a node that went away, the first of the remaining nodes by id.
+type Tracker struct {
+	idleAfter time.Duration
+	onChange  func(*Presence)
+	users     map[int64]*user
+	pending   []*Presence
+	notify    chan struct{}
+	mutex     sync.Mutex
+
+	broker      broker.Broker
+	node        string
+	nodeTimeout time.Duration
+	// Last message received from each other node
+	nodes    map[string]time.Time
+	outgoing []*broker.Message
+}
+
+func New(idleAfter time.Duration, onChange func(*Presence)) *Tracker {
+	tracker := new(Tracker)
+
+	tracker.idleAfter = idleAfter
+
+	tracker.onChange = onChange
+
+	tracker.users = make(map[int64]*user)
+
+	tracker.nodes = make(map[string]time.Time)
+
+	tracker.notify = make(chan struct{}, 1)
+
+	return tracker
+}
+
+// Bridge shares presence with other nodes through b: every node publishes
+// the status of its own connections and a heartbeat every Run interval. The
+// statuses of a node not heard from within timeout are dropped. Bridge must
+// be called before Run.
+func (t *Tracker) Bridge(b broker.Broker, node string, timeout time.Duration) error {
+	t.broker, t.node, t.nodeTimeout = b, node, timeout
+
+	if err := b.Subscribe(t.receive); err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Nodes already running answer with the users connected to them
+	t.send(&broker.Message{Kind: broker.KindPresenceSync})
+
+	return nil
+}
+
+// Run reports status changes to onChange, in order, publishes the changes of
+// the local connections, and marks inactive connections idle every interval.
+func (t *Tracker) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.notify:
+		case <-ticker.C:
+			t.sweep()
+
+			if t.broker != nil {
+				t.mutex.Lock()
+				t.send(&broker.Message{Kind: broker.KindPresenceNode})
+				t.mutex.Unlock()
+			}
+		}
+
+		t.flush()
+	}
+}
+
+// flush reports the queued changes to onChange and publishes the queued
+// messages.
+func (t *Tracker) flush() {
+	t.mutex.Lock()
+
+	pending, outgoing := t.pending, t.outgoing
+
+	t.pending, t.outgoing = nil, nil
+
+	t.mutex.Unlock()
+
+	if t.onChange != nil {
+		for _, p := range pending {
+			t.onChange(p)
+		}
+	}
+
+	for _, msg := range outgoing {
+		t.publish(msg)
+	}
+}
+
+func (t *Tracker) publish(msg *broker.Message) {
+	msg.Node = t.node
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	if err := t.broker.Publish(ctx, msg); err != nil {
+		log.Print(err)
+	}
+}
+
+// receive applies the presence published by another node.
+func (t *Tracker) receive(msg *broker.Message) {
+	if msg.Node == t.node {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.nodes[msg.Node] = time.Now()
+
+	switch msg.Kind {
+	case broker.KindPresence:
+		p := new(Presence)
+		if err := json.Unmarshal(msg.P, p); err != nil {
+			log.Print(err)
+			return
+		}
+
+		u := t.user(msg.UserID)
+
+		if p.LastSeenAt != nil && p.LastSeenAt.After(u.lastSeenAt) {
+			u.lastSeenAt = *p.LastSeenAt
+		}
+
+		if p.Status == StatusOffline {
+			delete(u.remote, msg.Node)
+		} else {
+			u.remote[msg.Node] = p
+		}
+
+		// The publishing node reports the change
+		t.aggregate(msg.UserID, u, false)
+
+	case broker.KindPresenceSync:
+		for userID, u := range t.users {
+			if u.local != StatusOffline {
+				t.send(t.message(userID, u))
+			}
+		}
+	}
+}
+
+// user returns the entry of userID, creating it. It must be called with the
+// lock held.
+func (t *Tracker) user(userID int64) *user {
+	u, ok := t.users[userID]
+	if !ok {
+		u = &user{
+			conns:  make(map[interface{}]*connection),
+			remote: make(map[string]*Presence),
+			local:  StatusOffline,
+			status: StatusOffline,
+		}
+
+		t.users[userID] = u
+	}
+
+	return u
+}
+
+// Connect records a new connection of userID. conn is any comparable value
+// identifying the connection.
+func (t *Tracker) Connect(userID int64, conn interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	u := t.user(userID)
+
+	u.conns[conn] = &connection{activeAt: time.Now()}
+
+	u.lastSeenAt = time.Now()
+
+	t.update(userID, u, false)
+}
+
+// Disconnect forgets a connection of userID.
+func (t *Tracker) Disconnect(userID int64, conn interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	u, ok := t.users[userID]
+	if !ok {
+		return
+	}
+
+	delete(u.conns, conn)
+
+	u.lastSeenAt = time.Now()
+
+	t.update(userID, u, false)
+}
+
+// Heartbeat marks a connection of userID as active, or as idle when the
+// client reports it.
+func (t *Tracker) Heartbeat(userID int64, conn interface{}, idle bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	u, ok := t.users[userID]
+	if !ok {
+		return
+	}
+
+	c, ok := u.conns[conn]
+	if !ok {
+		return
+	}
+
+	c.idle = idle
+
+	if !idle {
+		c.activeAt = time.Now()
+
+		u.lastSeenAt = c.activeAt
+	}
+
+	t.update(userID, u, false)
+}
+
+// Get returns the presence of userID across every bridged node. ok is false
+// when the user has no connection to any of them.
+func (t *Tracker) Get(userID int64) (p *Presence, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	u, ok := t.users[userID]
+	if !ok {
+		return &Presence{UserID: userID, Status: StatusOffline}, false
+	}
+
+	return u.presence(userID), true
+}
+
+func (t *Tracker) sweep() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	lost := false
+
+	// Users of a node that went away without saying so are no longer there
+	for node, seenAt := range t.nodes {
+		if time.Since(seenAt) < t.nodeTimeout {
+			continue
+		}
+
+		delete(t.nodes, node)
+
+		for _, u := range t.users {
+			delete(u.remote, node)
+		}
+
+		lost = true
+	}
+
+	// Every remaining node sees the users of the lost node go; one of them
+	// reports it
+	takeover := lost && t.first()
+
+	for userID, u := range t.users {
+		for _, c := range u.conns {
+			if time.Since(c.activeAt) >= t.idleAfter {
+				c.idle = true
+			}
+		}
+
+		t.update(userID, u, takeover)
+	}
+}
+
+// first reports whether this node comes first by id among the live nodes. It
+// must be called with the lock held.
+func (t *Tracker) first() bool {
+	for node := range t.nodes {
+		if node < t.node {
+			return false
+		}
+	}
+
+	return true
+}
+
+// update recomputes the status of the local connections of u, queues it for
+// the other nodes when it changed, then aggregates. A change of the
+// aggregated status is reported when the local connections made it, or when
+// takeover is set. It must be called with the lock held.
+func (t *Tracker) update(userID int64, u *user, takeover bool) {
+	local := StatusOffline
+
+	for _, c := range u.conns {
+		if !c.idle {
+			local = StatusOnline
+			break
+		}
+
+		local = StatusIdle
+	}
+
+	changed := local != u.local
+
+	if changed {
+		u.local = local
+
+		if t.broker != nil {
+			t.send(t.message(userID, u))
+		}
+	}
+
+	t.aggregate(userID, u, changed || takeover)
+}
+
+// aggregate recomputes the status of u on every node and, when report is
+// set, queues a change for onChange. It then drops u once it has no
+// connection left. It must be called with the lock held.
+func (t *Tracker) aggregate(userID int64, u *user, report bool) {
+	status := u.local
+
+	for _, p := range u.remote {
+		if p.Status == StatusOnline || p.Status == StatusIdle && status == StatusOffline {
+			status = p.Status
+		}
+	}
+
+	if status != u.status {
+		u.status = status
+
+		if report {
+			t.pending = append(t.pending, u.presence(userID))
+
+			t.wake()
+		}
+	}
+
+	// Users connected nowhere are forgotten; their last seen time went to
+	// onChange with the change to offline
+	if len(u.conns) == 0 && len(u.remote) == 0 {
+		delete(t.users, userID)
+	}
+}
+
+// message returns the presence of the local connections of u for the other
+// nodes. It must be called with the lock held.
+func (t *Tracker) message(userID int64, u *user) *broker.Message {
+	lastSeenAt := u.lastSeenAt
+
+	p, err := json.Marshal(&Presence{UserID: userID, Status: u.local, LastSeenAt: &lastSeenAt})
+	if err != nil {
+		log.Print(err)
+	}
+
+	return &broker.Message{Kind: broker.KindPresence, UserID: userID, P: p}
+}
+
+// send queues msg for Run to publish. It must be called with the lock held.
+func (t *Tracker) send(msg *broker.Message) {
+	t.outgoing = append(t.outgoing, msg)
+
+	t.wake()
+}
+
+func (t *Tracker) wake() {
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (u *user) presence(userID int64) *Presence {
+	p := &Presence{UserID: userID, Status: u.status}
+
+	if !u.lastSeenAt.IsZero() {
+		lastSeenAt := u.lastSeenAt
+		p.LastSeenAt = &lastSeenAt
+	}
+
+	return p
+}
@@ -0,0 +1,194 @@
+package presence
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"chatbox/pkg/channel/broker"
+	bmemory "chatbox/pkg/channel/broker/memory"
+)
+
+// remote returns the presence of userID published by node.
+func remote(t *testing.T, node string, userID int64, status string) *broker.Message {
+	t.Helper()
+
+	p, err := json.Marshal(&Presence{UserID: userID, Status: status})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &broker.Message{Node: node, Kind: broker.KindPresence, UserID: userID, P: p}
+}
+
+func TestForgetsDisconnectedUsers(t *testing.T) {
+	tracker := New(time.Minute, nil)
+
+	tracker.Connect(1, "a")
+	tracker.Connect(1, "b")
+	tracker.Disconnect(1, "a")
+
+	if p, ok := tracker.Get(1); !ok || p.Status != StatusOnline {
+		t.Fatalf("Get(1) = %+v, %v, want online", p, ok)
+	}
+
+	tracker.Disconnect(1, "b")
+
+	if _, ok := tracker.Get(1); ok {
+		t.Error("Get(1) found a user with no connection left")
+	}
+
+	if n := len(tracker.users); n != 0 {
+		t.Errorf("%d users tracked, want 0", n)
+	}
+}
+
+func TestForgetsRemoteUsers(t *testing.T) {
+	tracker := New(time.Minute, nil)
+	tracker.node, tracker.nodeTimeout = "local", time.Minute
+
+	tracker.receive(remote(t, "other", 1, StatusOnline))
+
+	if p, ok := tracker.Get(1); !ok || p.Status != StatusOnline {
+		t.Fatalf("Get(1) = %+v, %v, want online", p, ok)
+	}
+
+	tracker.receive(remote(t, "other", 1, StatusOffline))
+
+	if n := len(tracker.users); n != 0 {
+		t.Errorf("%d users tracked after going offline, want 0", n)
+	}
+
+	// An offline user never seen before is not kept either
+	tracker.receive(remote(t, "other", 2, StatusOffline))
+
+	if n := len(tracker.users); n != 0 {
+		t.Errorf("%d users tracked after an offline update, want 0", n)
+	}
+}
+
+func TestForgetsUsersOfLostNodes(t *testing.T) {
+	tracker := New(time.Minute, nil)
+	tracker.node, tracker.nodeTimeout = "local", time.Minute
+
+	tracker.receive(remote(t, "other", 1, StatusOnline))
+	tracker.Connect(2, "a")
+
+	tracker.nodes["other"] = time.Now().Add(-2 * time.Minute)
+	tracker.sweep()
+
+	if _, ok := tracker.users[1]; ok {
+		t.Error("user of a lost node still tracked")
+	}
+
+	if _, ok := tracker.users[2]; !ok {
+		t.Error("locally connected user forgotten")
+	}
+}
+
+// cluster is a set of trackers bridged through one memory broker, recording
+// every change any of them reports.
+type cluster struct {
+	trackers map[string]*Tracker
+	changes  []*Presence
+}
+
+func newCluster(t *testing.T, nodes ...string) *cluster {
+	t.Helper()
+
+	b := bmemory.New()
+
+	c := &cluster{trackers: make(map[string]*Tracker)}
+
+	for _, node := range nodes {
+		tracker := New(time.Minute, func(p *Presence) {
+			c.changes = append(c.changes, p)
+		})
+
+		if err := tracker.Bridge(b, node, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		c.trackers[node] = tracker
+	}
+
+	c.flush()
+	c.changes = nil
+
+	return c
+}
+
+// flush delivers the queued changes and messages, and those they cause in
+// turn.
+func (c *cluster) flush() {
+	for range 3 {
+		for _, tracker := range c.trackers {
+			tracker.flush()
+		}
+	}
+}
+
+// expect checks the changes reported since the last call.
+func (c *cluster) expect(t *testing.T, step string, statuses ...string) {
+	t.Helper()
+
+	c.flush()
+
+	got := []string{}
+	for _, p := range c.changes {
+		got = append(got, p.Status)
+	}
+
+	if !reflect.DeepEqual(got, append([]string{}, statuses...)) {
+		t.Errorf("%s: changes = %v, want %v", step, got, statuses)
+	}
+
+	c.changes = nil
+}
+
+func TestOneChangePerCluster(t *testing.T) {
+	c := newCluster(t, "a", "b", "c")
+	a, b := c.trackers["a"], c.trackers["b"]
+
+	a.Connect(1, "x")
+	c.expect(t, "connect", StatusOnline)
+
+	b.Connect(1, "y")
+	c.expect(t, "connect on another node")
+
+	b.Heartbeat(1, "y", true)
+	c.expect(t, "idle on one node")
+
+	a.Heartbeat(1, "x", true)
+	c.expect(t, "idle on every node", StatusIdle)
+
+	a.Disconnect(1, "x")
+	c.expect(t, "disconnect from one node")
+
+	b.Disconnect(1, "y")
+	c.expect(t, "disconnect", StatusOffline)
+
+	for node, tracker := range c.trackers {
+		if p, _ := tracker.Get(1); p.Status != StatusOffline {
+			t.Errorf("node %s: Get(1) = %s, want offline", node, p.Status)
+		}
+	}
+}
+
+func TestOneChangeForLostNode(t *testing.T) {
+	c := newCluster(t, "a", "b", "c")
+
+	c.trackers["b"].Connect(1, "x")
+	c.expect(t, "connect", StatusOnline)
+
+	// b stops without a word; a and c both find out
+	delete(c.trackers, "b")
+
+	for _, tracker := range c.trackers {
+		tracker.nodes["b"] = time.Now().Add(-2 * time.Minute)
+		tracker.sweep()
+	}
+
+	c.expect(t, "lost node", StatusOffline)
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Config limits the frames a websocket client may send.
+type Config struct {
+	// Sustained frames per second and burst of a single connection
+	Rate  float64
+	Burst int
+
+	// Sustained frames per second and burst of a user across connections
+	UserRate  float64
+	UserBurst int
+
+	// Largest frame, in bytes, that is handled. Frames above four times
+	// this size close the connection.
+	MaxFrameSize int64
+
+	// A connection is muted for MuteDuration after MaxViolations violations
+	// within ViolationWindow
+	MaxViolations   int
+	ViolationWindow time.Duration
+	MuteDuration    time.Duration
+}
+
+// Bucket is a token bucket refilled at rate tokens per second up to burst.
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token and reports whether one was available.
+func (b *Bucket) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// idle reports whether the bucket has refilled completely.
+func (b *Bucket) idle(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// Limiter keeps one bucket per key. Buckets that have refilled are dropped
+// periodically, since a new bucket starts full anyway.
+type Limiter struct {
+	rate    float64
+	burst   int
+	buckets map[int64]*Bucket
+	swept   time.Time
+	mutex   sync.Mutex
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[int64]*Bucket),
+		swept:   time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of key.
+func (l *Limiter) Allow(key int64) bool {
+	l.mutex.Lock()
+
+	now := time.Now()
+
+	if now.Sub(l.swept) >= time.Minute {
+		for k, b := range l.buckets {
+			if b.idle(now) {
+				delete(l.buckets, k)
+			}
+		}
+
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.rate, l.burst)
+
+		l.buckets[key] = b
+	}
+
+	l.mutex.Unlock()
+
+	return b.Allow()
+}
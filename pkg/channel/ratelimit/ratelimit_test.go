@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		elapsed time.Duration // since the bucket was drained
+		want    int           // tokens available afterwards
+	}{
+		{"no refill", 1, 3, 0, 0},
+		{"partial token", 1, 3, 500 * time.Millisecond, 0},
+		{"one token", 1, 3, time.Second, 1},
+		{"two tokens", 2, 3, time.Second, 2},
+		{"capped at burst", 10, 3, time.Minute, 3},
+		{"zero rate", 0, 2, time.Hour, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBucket(tt.rate, tt.burst)
+
+			for i := 0; i < tt.burst; i++ {
+				if !b.Allow() {
+					t.Fatalf("Allow() = false on token %d of a full bucket", i+1)
+				}
+			}
+
+			// Drain what refilled meanwhile, then wind the clock back
+			for b.Allow() {
+			}
+			b.tokens = 0
+			b.last = time.Now().Add(-tt.elapsed)
+
+			got := 0
+			for b.Allow() {
+				got++
+				if got > tt.burst {
+					break
+				}
+			}
+
+			if got != tt.want {
+				t.Errorf("got %d tokens, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketIdle(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		tokens float64
+		last   time.Time
+		want   bool
+	}{
+		{"full", 2, now, true},
+		{"drained", 0, now, false},
+		{"refilled", 0, now.Add(-2 * time.Second), true},
+		{"refilling", 0, now.Add(-time.Second), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBucket(1, 2)
+			b.tokens, b.last = tt.tokens, tt.last
+
+			if got := b.idle(now); got != tt.want {
+				t.Errorf("idle() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		keys  []int64
+		want  []bool
+		burst int
+	}{
+		{"within burst", []int64{1, 1}, []bool{true, true}, 2},
+		{"over burst", []int64{1, 1, 1}, []bool{true, true, false}, 2},
+		{"keys are separate", []int64{1, 1, 2, 2, 1}, []bool{true, false, true, false, false}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(0, tt.burst)
+
+			for i, key := range tt.keys {
+				if got := l.Allow(key); got != tt.want[i] {
+					t.Errorf("Allow(%d) #%d = %v, want %v", key, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l := NewLimiter(1, 1)
+
+	l.Allow(1)
+	l.Allow(2)
+
+	// Key 1 has refilled, key 2 has not
+	l.buckets[1].last = time.Now().Add(-time.Hour)
+	l.swept = time.Now().Add(-2 * time.Minute)
+
+	l.Allow(3)
+
+	if _, ok := l.buckets[1]; ok {
+		t.Error("refilled bucket was not swept")
+	}
+	if _, ok := l.buckets[2]; !ok {
+		t.Error("draining bucket was swept")
+	}
+	if _, ok := l.buckets[3]; !ok {
+		t.Error("bucket of the new key is missing")
+	}
+}
@@ -0,0 +1,77 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"strconv"
+
+	"chatbox/pkg/channel/event"
+)
+
+// Stream is a Server-Sent Events transport for hub clients. Every frame is
+// sent as the data of one event.
+type Stream struct {
+	w *bufio.Writer
+}
+
+func New(w *bufio.Writer) *Stream {
+	return &Stream{w: w}
+}
+
+// WriteFrame writes p as an event. Created messages carry their id as the
+// event id, so a reconnecting client resumes through Last-Event-ID.
+func (s *Stream) WriteFrame(p []byte) error {
+	if id := messageID(p); id != 0 {
+		_, _ = s.w.WriteString("id: " + strconv.FormatInt(id, 10) + "\n")
+	}
+
+	_, _ = s.w.WriteString("data: ")
+	_, _ = s.w.Write(p)
+	_, _ = s.w.WriteString("\n\n")
+
+	return s.w.Flush()
+}
+
+// Ping writes a comment line, which clients ignore.
+func (s *Stream) Ping() error {
+	_, _ = s.w.WriteString(": ping\n\n")
+
+	return s.w.Flush()
+}
+
+// Close sends a close event when code is non-zero. The stream itself ends
+// when the handler writing it returns.
+func (s *Stream) Close(code int, text string) error {
+	if code == 0 {
+		return nil
+	}
+
+	p, err := event.New(event.TypeClose, "", map[string]interface{}{
+		"code":   code,
+		"reason": text,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.WriteFrame(p)
+}
+
+// messageID returns the id of the message carried by a message.created
+// frame, or zero for any other frame.
+func messageID(p []byte) int64 {
+	env := new(event.Envelope)
+	if err := json.Unmarshal(p, env); err != nil || env.Type != event.TypeMessageCreated {
+		return 0
+	}
+
+	var msg struct {
+		ID int64 `json:"id"`
+	}
+
+	if err := json.Unmarshal(env.Payload, &msg); err != nil {
+		return 0
+	}
+
+	return msg.ID
+}
@@ -0,0 +1,90 @@
+package typing
+
+import (
+	"sync"
+	"time"
+)
+
+type key struct {
+	room   string
+	userID int64
+}
+
+// Tracker keeps the typing state of users per room. A state that is not
+// refreshed within the expiration is cleared and reported through OnExpire.
+type Tracker struct {
+	expiration time.Duration
+	onExpire   func(room string, userID int64)
+	timers     map[key]*time.Timer
+	mutex      sync.Mutex
+}
+
+func New(expiration time.Duration, onExpire func(room string, userID int64)) *Tracker {
+	tracker := new(Tracker)
+
+	tracker.expiration = expiration
+
+	tracker.onExpire = onExpire
+
+	tracker.timers = make(map[key]*time.Timer)
+
+	return tracker
+}
+
+// Start marks userID as typing in room, or refreshes the state. It reports
+// whether the user was not typing before.
+func (t *Tracker) Start(room string, userID int64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	k := key{room: room, userID: userID}
+
+	if timer, ok := t.timers[k]; ok {
+		timer.Stop()
+	}
+
+	_, typing := t.timers[k]
+
+	var timer *time.Timer
+	timer = time.AfterFunc(t.expiration, func() {
+		t.mutex.Lock()
+
+		// A newer Start replaced this timer
+		if t.timers[k] != timer {
+			t.mutex.Unlock()
+			return
+		}
+
+		delete(t.timers, k)
+
+		t.mutex.Unlock()
+
+		if t.onExpire != nil {
+			t.onExpire(room, userID)
+		}
+	})
+
+	t.timers[k] = timer
+
+	return !typing
+}
+
+// Stop clears the typing state of userID in room. It reports whether the
+// user was typing.
+func (t *Tracker) Stop(room string, userID int64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	k := key{room: room, userID: userID}
+
+	timer, ok := t.timers[k]
+	if !ok {
+		return false
+	}
+
+	timer.Stop()
+
+	delete(t.timers, k)
+
+	return true
+}
@@ -5,7 +5,9 @@ import (
 	"database/sql"
 	"fmt"
 
-	_ "github.com/lib/pq"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type Config struct {
@@ -16,6 +18,7 @@ type Config struct {
 type PostgresDB struct {
 	DB   *sql.DB
 	Conn *sql.Conn
+	dsn  string
 }
 
 func Open(ctx context.Context, config Config) (*PostgresDB, error) {
@@ -43,6 +46,7 @@ func Open(ctx context.Context, config Config) (*PostgresDB, error) {
 	return &PostgresDB{
 		DB:   db,
 		Conn: conn,
+		dsn:  dsn,
 	}, nil
 }
 
@@ -54,3 +58,8 @@ func (p *PostgresDB) Close() error {
 func (p *PostgresDB) Ping(ctx context.Context) error {
 	return p.Conn.PingContext(ctx)
 }
+
+// NewListener opens a LISTEN connection with the same settings as the pool.
+func (p *PostgresDB) NewListener(minReconnect, maxReconnect time.Duration, callback pq.EventCallbackType) *pq.Listener {
+	return pq.NewListener(p.dsn, minReconnect, maxReconnect, callback)
+}
@@ -0,0 +1,24 @@
+package body
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"chatbox/pkg/settings"
+)
+
+// Limit refuses bodies over settings.BodyLimit with 413. The server accepts
+// bodies up to settings.FiberConfig.BodyLimit so that files can be uploaded;
+// only settings.UploadPath may send that much.
+func Limit(c *fiber.Ctx) error {
+	if strings.EqualFold(c.Path(), settings.UploadPath) {
+		return c.Next()
+	}
+
+	if len(c.Body()) > settings.BodyLimit {
+		return fiber.ErrRequestEntityTooLarge
+	}
+
+	return c.Next()
+}
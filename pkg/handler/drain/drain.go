@@ -0,0 +1,22 @@
+package drain
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"chatbox/pkg/channel"
+	"chatbox/pkg/settings"
+)
+
+// Streams rejects new sockets and event streams once the hubs are shutting
+// down, telling clients when to retry.
+func Streams(c *fiber.Ctx) error {
+	if channel.ChatHub.Closing() || channel.NotificationHub.Closing() {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(settings.ShutdownReconnectDelay.Seconds())))
+
+		return fiber.ErrServiceUnavailable
+	}
+
+	return c.Next()
+}
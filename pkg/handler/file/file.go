@@ -1,35 +1,166 @@
 package file
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"log"
 
 	"github.com/gofiber/fiber/v2"
+
+	"chatbox/pkg/media"
+	"chatbox/pkg/settings"
+	"chatbox/pkg/storage"
 )
 
+// Policy is what Upload checks files against, set at startup.
+var Policy storage.Policy
+
+// File is a stored upload. Key names the stored object; Name is the filename
+// the client uploaded it as and is never used as a path.
+type File struct {
+	Key         string
+	Name        string
+	ContentType string
+	Size        int64
+	Checksum    string
+}
+
+// Upload stores the "file" form field in storage.Files under a
+// server-generated key and passes the stored File to the next handler through
+// c.Locals("file"). The content type is sniffed from the bytes and checked
+// against Policy. JPEG and PNG images are stripped of their
+// metadata first.
 func Upload(c *fiber.Ctx) error {
-	file, err := c.FormFile("file")
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		log.Print(err)
+
+		return fiber.NewError(fiber.StatusBadRequest, "Missing file")
+	}
+
+	if header.Size > Policy.MaxSize {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge, "File exceeds the size limit")
+	}
+
+	src, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	contentType, r, err := storage.Sniff(src)
 	if err != nil {
 		log.Print(err)
 
 		return err
 	}
 
-	if err := c.SaveFile(file, fmt.Sprintf("./tmp/%s", file.Filename)); err != nil {
+	if !Policy.Permits(contentType) {
+		return fiber.NewError(fiber.StatusUnsupportedMediaType, "File type not allowed")
+	}
+
+	size := header.Size
+
+	// Images are stored without their EXIF metadata, GPS position included
+	if media.Strippable(contentType) {
+		data, err := io.ReadAll(io.LimitReader(r, Policy.MaxSize+1))
+		if err != nil {
+			return err
+		}
+
+		data, err = media.Strip(contentType, data)
+		if err != nil {
+			log.Print(err)
+
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "Malformed image")
+		}
+
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	key, err := storage.NewKey()
+	if err != nil {
+		return err
+	}
+
+	// The checksum is computed while the file is written
+	hash := sha256.New()
+
+	if err := storage.Files.Put(ctx, key, io.TeeReader(r, hash), size, contentType); err != nil {
 		log.Print(err)
 
 		return err
 	}
 
-	return c.SendStatus(fiber.StatusOK)
+	c.Locals("file", &File{
+		Key:         key,
+		Name:        storage.CleanName(header.Filename),
+		ContentType: contentType,
+		Size:        size,
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+	})
+
+	return c.Next()
 }
 
+// Download sends the File a previous handler put in c.Locals("file") as an
+// attachment named after its original filename. Drivers that presign URLs
+// redirect to the storage instead.
 func Download(c *fiber.Ctx) error {
-	if err := c.Download(fmt.Sprintf("./tmp/%s", c.Params("filename")), c.Params("filename")); err != nil {
+	file, ok := c.Locals("file").(*File)
+	if !ok {
+		return fiber.ErrNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	url, err := storage.Files.Presign(ctx, file.Key, file.Name, settings.FilePresignExpiration)
+	if err == nil {
+		c.Set(fiber.HeaderCacheControl, settings.CacheControlNoStore)
+
+		return c.Redirect(url, fiber.StatusFound)
+	}
+
+	if err != storage.ErrNotSupported {
 		log.Print(err)
 
 		return err
 	}
 
-	return nil
+	// The body is streamed after the handler returns, so reading it is not
+	// bound to the timeout
+	r, obj, err := storage.Files.Get(context.Background(), file.Key)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return fiber.ErrNotFound
+		}
+
+		log.Print(err)
+
+		return err
+	}
+
+	c.Attachment(file.Name)
+
+	// Keys have no extension to guess the type from, and browsers must not
+	// guess one either
+	c.Set(fiber.HeaderContentType, file.ContentType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+
+	return c.SendStream(r, int(obj.Size))
+}
+
+// Remove deletes a stored file, for uploads that could not be recorded.
+func Remove(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+
+	return storage.Files.Delete(ctx, key)
 }
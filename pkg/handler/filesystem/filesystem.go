@@ -5,8 +5,11 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
+
+	"chatbox/pkg/settings"
 )
 
 var Static fiber.Handler = filesystem.New(filesystem.Config{
-	Root: http.Dir("./tmp"),
+	// Never ./tmp, which holds the logs
+	Root: http.Dir(settings.StaticRoot),
 })
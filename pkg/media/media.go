@@ -0,0 +1,297 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+var (
+	ErrUnsupported = errors.New("media: unsupported image format")
+
+	ErrTooLarge = errors.New("media: image dimensions too large")
+)
+
+// Previewable reports whether thumbnails can be made from files of
+// contentType.
+func Previewable(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+
+	return false
+}
+
+// Size is a named thumbnail size, the longest side in pixels.
+type Size struct {
+	Name string
+	Max  int
+}
+
+// Image is a decoded image in its upright orientation.
+type Image struct {
+	RGBA        *image.RGBA
+	Orientation int
+	// Whether variants are encoded as PNG to keep transparency
+	Lossless bool
+}
+
+// Variant is an encoded thumbnail.
+type Variant struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// Decode decodes a JPEG, PNG or GIF image, refusing images of more than
+// maxPixels pixels before allocating them. Images that cannot be decoded fail
+// with an error wrapping ErrMalformed.
+func Decode(data []byte, maxPixels int) (*Image, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrMalformed
+	}
+
+	if config.Width*config.Height > maxPixels {
+		return nil, ErrTooLarge
+	}
+
+	var src image.Image
+
+	switch format {
+	case "jpeg":
+		src, err = jpeg.Decode(bytes.NewReader(data))
+	case "png":
+		src, err = png.Decode(bytes.NewReader(data))
+	case "gif":
+		// Animated images are previewed by their first frame
+		src, err = gif.Decode(bytes.NewReader(data))
+	default:
+		return nil, ErrUnsupported
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	img := &Image{
+		RGBA:        image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy())),
+		Orientation: 1,
+		Lossless:    format != "jpeg",
+	}
+
+	draw.Draw(img.RGBA, img.RGBA.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	if format == "jpeg" {
+		img.Orientation = Orientation(data)
+	}
+
+	return img, nil
+}
+
+// Size returns the dimensions of the image as displayed.
+func (i *Image) Size() (int, int) {
+	w, h := i.RGBA.Rect.Dx(), i.RGBA.Rect.Dy()
+
+	// Orientations 5 to 8 are rotated by a quarter turn
+	if i.Orientation >= 5 {
+		return h, w
+	}
+
+	return w, h
+}
+
+// Thumbnail returns an upright copy of the image whose longer side is at
+// most size pixels. Images already small enough are never upscaled.
+func (i *Image) Thumbnail(size int) *Image {
+	w, h := i.RGBA.Rect.Dx(), i.RGBA.Rect.Dy()
+
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+
+	return &Image{
+		RGBA:        orient(resize(i.RGBA, w, h), i.Orientation),
+		Orientation: 1,
+		Lossless:    i.Lossless,
+	}
+}
+
+// Encode encodes the image as a JPEG, or as a PNG when it comes from a
+// format that may have transparency.
+func (i *Image) Encode() (*Variant, error) {
+	buf := new(bytes.Buffer)
+
+	v := &Variant{
+		Width:  i.RGBA.Rect.Dx(),
+		Height: i.RGBA.Rect.Dy(),
+	}
+
+	if i.Lossless {
+		v.ContentType = "image/png"
+
+		if err := (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(buf, i.RGBA); err != nil {
+			return nil, err
+		}
+	} else {
+		v.ContentType = "image/jpeg"
+
+		if err := jpeg.Encode(buf, i.RGBA, &jpeg.Options{Quality: 80}); err != nil {
+			return nil, err
+		}
+	}
+
+	v.Data = buf.Bytes()
+
+	return v, nil
+}
+
+// DominantColor returns the most common color of the opaque pixels of the
+// image as #rrggbb, to be shown while a preview loads.
+func (i *Image) DominantColor() string {
+	var (
+		counts [4096]int
+		sums   [4096][3]int
+	)
+
+	pix := i.RGBA.Pix
+
+	for p := 0; p+3 < len(pix); p += 4 {
+		a := int(pix[p+3])
+		if a < 128 {
+			continue
+		}
+
+		r, g, bl := int(pix[p])*255/a, int(pix[p+1])*255/a, int(pix[p+2])*255/a
+
+		// Pixels are grouped by the high 4 bits of each channel
+		b := r>>4<<8 | g>>4<<4 | bl>>4
+
+		counts[b]++
+		sums[b][0] += r
+		sums[b][1] += g
+		sums[b][2] += bl
+	}
+
+	best := -1
+
+	for b := range counts {
+		if counts[b] > 0 && (best < 0 || counts[b] > counts[best]) {
+			best = b
+		}
+	}
+
+	if best < 0 {
+		return ""
+	}
+
+	n := counts[best]
+
+	return fmt.Sprintf("#%02x%02x%02x", sums[best][0]/n, sums[best][1]/n, sums[best][2]/n)
+}
+
+// resize scales src to w by h with a box filter, averaging every source
+// pixel covered by a destination pixel. Colors are alpha-premultiplied, so
+// transparent pixels don't darken the edges.
+func resize(src *image.RGBA, w, h int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+
+	if sw == w && sh == h {
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		copy(dst.Pix, src.Pix)
+
+		return dst
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+
+			var r, g, b, a, n int
+
+			for sy := y0; sy < y1; sy++ {
+				p := sy*src.Stride + x0*4
+
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[p])
+					g += int(src.Pix[p+1])
+					b += int(src.Pix[p+2])
+					a += int(src.Pix[p+3])
+					n++
+					p += 4
+				}
+			}
+
+			d := y*dst.Stride + x*4
+
+			dst.Pix[d] = uint8(r / n)
+			dst.Pix[d+1] = uint8(g / n)
+			dst.Pix[d+2] = uint8(b / n)
+			dst.Pix[d+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+// orient applies an EXIF orientation to src.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+
+	w, h := sw, sh
+	if orientation >= 5 {
+		w, h = sh, sw
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			var dx, dy int
+
+			switch orientation {
+			case 2: // Mirrored
+				dx, dy = sw-1-x, y
+			case 3: // Rotated 180°
+				dx, dy = sw-1-x, sh-1-y
+			case 4: // Flipped
+				dx, dy = x, sh-1-y
+			case 5: // Transposed
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise
+				dx, dy = sh-1-y, x
+			case 7: // Transversed
+				dx, dy = sh-1-y, sw-1-x
+			case 8: // Rotated 90° counterclockwise
+				dx, dy = y, sw-1-x
+			}
+
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], src.Pix[y*src.Stride+x*4:y*src.Stride+x*4+4])
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,190 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// labeled returns a w by h image whose pixels have the red values 1, 2, 3...
+// row by row.
+func labeled(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(1 + y*w + x), A: 255})
+		}
+	}
+
+	return img
+}
+
+// labels returns the red values of img row by row.
+func labels(img *image.RGBA) [][]uint8 {
+	rows := [][]uint8{}
+
+	for y := 0; y < img.Rect.Dy(); y++ {
+		row := []uint8{}
+		for x := 0; x < img.Rect.Dx(); x++ {
+			row = append(row, img.RGBAAt(x, y).R)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+func TestOrient(t *testing.T) {
+	// 1 2 3
+	// 4 5 6
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{0, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{1, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{2, [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+		{3, [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+		{4, [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+		{5, [][]uint8{{1, 4}, {2, 5}, {3, 6}}},
+		{6, [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+		{7, [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+		{8, [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+		{9, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+	}
+
+	for _, tt := range tests {
+		got := labels(orient(labeled(3, 2), tt.orientation))
+
+		if !equalRows(got, tt.want) {
+			t.Errorf("orient(%d) = %v, want %v", tt.orientation, got, tt.want)
+		}
+	}
+}
+
+func equalRows(a, b [][]uint8) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestThumbnail(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		orientation   int
+		size          int
+		wantW, wantH  int
+	}{
+		{"landscape", 400, 200, 1, 100, 100, 50},
+		{"portrait", 200, 400, 1, 100, 50, 100},
+		{"square", 300, 300, 1, 100, 100, 100},
+		{"not upscaled", 50, 20, 1, 100, 50, 20},
+		{"exact", 100, 60, 1, 100, 100, 60},
+		{"thin", 1000, 4, 1, 100, 100, 1},
+		{"rotated", 400, 200, 6, 100, 50, 100},
+		{"mirrored", 400, 200, 2, 100, 100, 50},
+		{"rotated small", 40, 20, 8, 100, 20, 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewRGBA(image.Rect(0, 0, tt.width, tt.height))
+			for p := 0; p < len(src.Pix); p += 4 {
+				copy(src.Pix[p:], []uint8{200, 100, 50, 255})
+			}
+
+			img := &Image{RGBA: src, Orientation: tt.orientation, Lossless: true}
+
+			thumb := img.Thumbnail(tt.size)
+
+			if w, h := thumb.RGBA.Rect.Dx(), thumb.RGBA.Rect.Dy(); w != tt.wantW || h != tt.wantH {
+				t.Errorf("Thumbnail(%d) is %dx%d, want %dx%d", tt.size, w, h, tt.wantW, tt.wantH)
+			}
+
+			if w, h := thumb.Size(); w != tt.wantW || h != tt.wantH {
+				t.Errorf("Size() = %dx%d, want %dx%d", w, h, tt.wantW, tt.wantH)
+			}
+
+			if thumb.Orientation != 1 || !thumb.Lossless {
+				t.Errorf("Thumbnail() orientation = %d, lossless = %v", thumb.Orientation, thumb.Lossless)
+			}
+
+			if c := thumb.RGBA.RGBAAt(0, 0); c != (color.RGBA{200, 100, 50, 255}) {
+				t.Errorf("Thumbnail() color = %v", c)
+			}
+		})
+	}
+}
+
+func TestThumbnailOriented(t *testing.T) {
+	img := &Image{RGBA: labeled(3, 2), Orientation: 6}
+
+	// Not resized, only rotated
+	got := labels(img.Thumbnail(10).RGBA)
+	want := [][]uint8{{4, 1}, {5, 2}, {6, 3}}
+
+	if !equalRows(got, want) {
+		t.Errorf("Thumbnail() = %v, want %v", got, want)
+	}
+}
+
+func TestThumbnailTransparentEdges(t *testing.T) {
+	// A red pixel next to a transparent one averages to half-opaque red,
+	// not to a darker red
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.SetRGBA(0, 0, color.RGBA{R: 255, A: 255})
+
+	thumb := (&Image{RGBA: src, Orientation: 1}).Thumbnail(1)
+
+	if c := thumb.RGBA.RGBAAt(0, 0); c != (color.RGBA{R: 127, A: 127}) {
+		t.Errorf("Thumbnail() color = %v, want %v", c, color.RGBA{R: 127, A: 127})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, labeled(4, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		maxPixels int
+		wantErr   error
+	}{
+		{"png", buf.Bytes(), 12, nil},
+		{"too large", buf.Bytes(), 11, ErrTooLarge},
+		{"truncated", buf.Bytes()[:buf.Len()/2], 12, ErrMalformed},
+		{"not an image", []byte("hello"), 12, ErrMalformed},
+		{"jpeg", encodeJPEG(t, 4, 3), 12, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := Decode(tt.data, tt.maxPixels)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if err == nil {
+				if w, h := img.Size(); w != 4 || h != 3 {
+					t.Errorf("Size() = %dx%d, want 4x3", w, h)
+				}
+			}
+		})
+	}
+}
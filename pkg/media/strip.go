@@ -0,0 +1,397 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrMalformed = errors.New("media: malformed image")
+
+// JPEG markers
+const (
+	markerTEM   byte = 0x01
+	markerRST0  byte = 0xD0
+	markerRST7  byte = 0xD7
+	markerSOI   byte = 0xD8
+	markerEOI   byte = 0xD9
+	markerSOS   byte = 0xDA
+	markerAPP0  byte = 0xE0
+	markerAPP1  byte = 0xE1
+	markerAPP2  byte = 0xE2
+	markerAPP14 byte = 0xEE
+	markerCOM   byte = 0xFE
+)
+
+// APP2 is also used by Multi-Picture Format, whose secondary images carry
+// EXIF of their own; only ICC profiles are kept
+var iccProfile = []byte("ICC_PROFILE\x00")
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// GIF blocks
+const (
+	gifExtension byte = 0x21
+	gifImage     byte = 0x2C
+	gifTrailer   byte = 0x3B
+
+	gifComment     byte = 0xFE
+	gifApplication byte = 0xFF
+)
+
+// GIF application extensions needed to play the image: looping and ICC
+// profiles. Others, such as XMP, are metadata.
+var gifApplications = map[string]bool{
+	"NETSCAPE2.0": true,
+	"ANIMEXTS1.0": true,
+	"ICCRGBG1012": true,
+}
+
+// PNG chunks that carry metadata rather than pixels
+var pngMetadata = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// Strippable reports whether Strip removes metadata from files of
+// contentType.
+func Strippable(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+
+	return false
+}
+
+// Strip removes the EXIF, XMP, IPTC and text metadata of a JPEG, PNG or GIF
+// image, GPS position included, without re-encoding its pixels. Anything
+// after the end of the image, such as the secondary images phones append to
+// a JPEG, is dropped. A JPEG keeps its orientation in a minimal EXIF segment
+// of its own.
+func Strip(contentType string, data []byte) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	case "image/gif":
+		return stripGIF(data)
+	}
+
+	return data, nil
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, ErrMalformed
+	}
+
+	orientation := Orientation(data)
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	inserted := orientation <= 1
+
+	for i := 2; ; {
+		if i+2 > len(data) || data[i] != 0xFF {
+			return nil, ErrMalformed
+		}
+
+		marker := data[i+1]
+
+		// Fill bytes before a marker
+		if marker == 0xFF {
+			i++
+			continue
+		}
+
+		if marker == markerEOI {
+			out.Write(data[i : i+2])
+			return out.Bytes(), nil
+		}
+
+		// Markers without a segment
+		if marker == markerTEM || marker >= markerRST0 && marker <= markerRST7 {
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+
+		// The orientation goes after the JFIF segment, which must come first
+		if !inserted && marker != markerAPP0 {
+			out.Write(orientationSegment(orientation))
+			inserted = true
+		}
+
+		if i+4 > len(data) {
+			return nil, ErrMalformed
+		}
+
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return nil, ErrMalformed
+		}
+
+		// JFIF, ICC profiles and Adobe color transforms are needed to
+		// render the image; other application segments and comments are
+		// metadata
+		keep := marker == markerAPP0 || marker == markerAPP14 ||
+			marker == markerAPP2 && bytes.HasPrefix(data[i+4:end], iccProfile) ||
+			marker < markerAPP0 || marker > 0xEF && marker != markerCOM
+
+		if keep {
+			out.Write(data[i:end])
+		}
+
+		i = end
+
+		// A scan is followed by its entropy-coded data, up to the next
+		// marker; progressive images have several
+		if marker == markerSOS {
+			next := scanEnd(data, i)
+
+			out.Write(data[i:next])
+
+			i = next
+		}
+	}
+}
+
+// scanEnd returns the offset of the marker ending the entropy-coded data
+// that starts at i. Within the data, 0xFF is followed by a stuffed zero or a
+// restart marker.
+func scanEnd(data []byte, i int) int {
+	for ; i+1 < len(data); i++ {
+		if data[i] != 0xFF {
+			continue
+		}
+
+		next := data[i+1]
+
+		if next != 0x00 && (next < markerRST0 || next > markerRST7) {
+			return i
+		}
+	}
+
+	return len(data)
+}
+
+// orientationSegment returns an APP1 segment holding only an EXIF
+// orientation.
+func orientationSegment(orientation int) []byte {
+	segment := []byte{
+		0xFF, markerAPP1, 0x00, 0x22,
+		'E', 'x', 'i', 'f', 0x00, 0x00,
+		// Big-endian TIFF header, IFD0 at offset 8
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08,
+		// One entry: orientation, SHORT, count 1
+		0x00, 0x01,
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, byte(orientation), 0x00, 0x00,
+		// No next IFD
+		0x00, 0x00, 0x00, 0x00,
+	}
+
+	return segment
+}
+
+// Orientation returns the EXIF orientation of a JPEG image, 1 to 8, or 1
+// when it has none.
+func Orientation(data []byte) int {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == markerSOS {
+			break
+		}
+
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			break
+		}
+
+		if marker == markerAPP1 && bytes.HasPrefix(data[i+4:end], []byte("Exif\x00\x00")) {
+			if o := tiffOrientation(data[i+10 : end]); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+
+		i = end
+	}
+
+	return 1
+}
+
+// tiffOrientation reads the orientation tag of IFD0 of a TIFF structure.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+
+	count := int(order.Uint16(tiff[ifd:]))
+
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+
+	return 0
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrMalformed
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	for i := len(pngSignature); ; {
+		if i+12 > len(data) {
+			return nil, ErrMalformed
+		}
+
+		// Length, type, data and CRC
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			return nil, ErrMalformed
+		}
+
+		typ := string(data[i+4 : i+8])
+
+		if !pngMetadata[typ] {
+			out.Write(data[i:end])
+		}
+
+		if typ == "IEND" {
+			return out.Bytes(), nil
+		}
+
+		i = end
+	}
+}
+
+func stripGIF(data []byte) ([]byte, error) {
+	// Header and logical screen descriptor
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF87a")) && !bytes.HasPrefix(data, []byte("GIF89a")) {
+		return nil, ErrMalformed
+	}
+
+	i := 13
+
+	// Global color table
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+
+	if i > len(data) {
+		return nil, ErrMalformed
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:i])
+
+	for i < len(data) {
+		start := i
+
+		switch data[i] {
+		case gifTrailer:
+			out.WriteByte(gifTrailer)
+			return out.Bytes(), nil
+
+		case gifExtension:
+			if i+2 > len(data) {
+				return nil, ErrMalformed
+			}
+
+			label := data[i+1]
+
+			end, ok := gifSubBlocks(data, i+2)
+			if !ok {
+				return nil, ErrMalformed
+			}
+
+			i = end
+
+			// The first sub-block of an application extension holds its
+			// identifier and authentication code
+			keep := label != gifComment
+			if label == gifApplication {
+				keep = i-start > 14 && data[start+2] == 11 && gifApplications[string(data[start+3:start+14])]
+			}
+
+			if keep {
+				out.Write(data[start:i])
+			}
+
+		case gifImage:
+			if i+10 > len(data) {
+				return nil, ErrMalformed
+			}
+
+			i += 10
+
+			// Local color table
+			if data[start+9]&0x80 != 0 {
+				i += 3 << (data[start+9]&0x07 + 1)
+			}
+
+			// LZW minimum code size, then the image data
+			end, ok := gifSubBlocks(data, i+1)
+			if !ok {
+				return nil, ErrMalformed
+			}
+
+			i = end
+
+			out.Write(data[start:i])
+
+		default:
+			return nil, ErrMalformed
+		}
+	}
+
+	return nil, ErrMalformed
+}
+
+// gifSubBlocks returns the offset after the data sub-blocks starting at i,
+// which end with an empty block.
+func gifSubBlocks(data []byte, i int) (int, bool) {
+	for i < len(data) {
+		size := int(data[i])
+		i++
+
+		if size == 0 {
+			return i, true
+		}
+
+		i += size
+	}
+
+	return 0, false
+}
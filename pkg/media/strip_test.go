@@ -0,0 +1,444 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// encodeJPEG returns a w by h JPEG without application segments.
+func encodeJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, labeled(w, h), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// withSegments inserts segments right after the SOI marker of a JPEG.
+func withSegments(data []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+
+	return append(out, data[2:]...)
+}
+
+// segment returns a JPEG marker segment.
+func segment(marker byte, payload []byte) []byte {
+	s := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(s[2:], uint16(len(payload)+2))
+
+	return append(s, payload...)
+}
+
+// exif returns an EXIF APP1 segment with an orientation tag, followed by a
+// GPS latitude ref tag holding a recognizable marker.
+func exif(order binary.ByteOrder, orientation int) []byte {
+	tiff := make([]byte, 8+2+2*12+4)
+
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 2)
+
+	// Orientation, SHORT, 1
+	entry := tiff[10:]
+	order.PutUint16(entry, 0x0112)
+	order.PutUint16(entry[2:], 3)
+	order.PutUint32(entry[4:], 1)
+	order.PutUint16(entry[8:], uint16(orientation))
+
+	// GPSLatitudeRef, ASCII, 2
+	entry = tiff[22:]
+	order.PutUint16(entry, 0x0001)
+	order.PutUint16(entry[2:], 2)
+	order.PutUint32(entry[4:], 2)
+	copy(entry[8:], "N\x00")
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+
+	return segment(markerAPP1, append(payload, "GPS!"...))
+}
+
+func TestOrientation(t *testing.T) {
+	plain := encodeJPEG(t, 4, 2)
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"none", plain, 1},
+		{"big-endian", withSegments(plain, exif(binary.BigEndian, 6)), 6},
+		{"little-endian", withSegments(plain, exif(binary.LittleEndian, 8)), 8},
+		{"after JFIF", withSegments(plain, segment(markerAPP0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")), exif(binary.BigEndian, 3)), 3},
+		{"out of range", withSegments(plain, exif(binary.BigEndian, 9)), 1},
+		{"zero", withSegments(plain, exif(binary.BigEndian, 0)), 1},
+		{"not EXIF", withSegments(plain, segment(markerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00"))), 1},
+		{"minimal segment", withSegments(plain, orientationSegment(5)), 5},
+		{"truncated", withSegments(plain, exif(binary.BigEndian, 6))[:30], 1},
+		{"empty", nil, 1},
+	}
+
+	for _, tt := range tests {
+		if got := Orientation(tt.data); got != tt.want {
+			t.Errorf("%s: Orientation() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	plain := encodeJPEG(t, 4, 2)
+
+	jfif := segment(markerAPP0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+	xmp := segment(markerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>GPS!</x:xmpmeta>"))
+	icc := segment(markerAPP2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+	mpf := segment(markerAPP2, []byte("MPF\x00GPS!"))
+	iptc := segment(0xED, []byte("Photoshop 3.0\x00GPS!"))
+	adobe := segment(markerAPP14, []byte("Adobe\x00\x64\x00\x00\x00\x00\x01"))
+	comment := segment(markerCOM, []byte("GPS!"))
+
+	tests := []struct {
+		name            string
+		data            []byte
+		keep            [][]byte
+		wantOrientation int
+	}{
+		{"plain", plain, nil, 1},
+		{"exif", withSegments(plain, exif(binary.BigEndian, 1)), nil, 1},
+		{"exif rotated", withSegments(plain, exif(binary.LittleEndian, 6)), [][]byte{orientationSegment(6)}, 6},
+		{"jfif first", withSegments(plain, jfif, exif(binary.BigEndian, 8)), [][]byte{append(append([]byte{}, jfif...), orientationSegment(8)...)}, 8},
+		{"xmp", withSegments(plain, xmp), nil, 1},
+		{"icc", withSegments(plain, icc), [][]byte{icc}, 1},
+		{"mpf", withSegments(plain, mpf), nil, 1},
+		{"iptc", withSegments(plain, iptc), nil, 1},
+		{"adobe", withSegments(plain, adobe), [][]byte{adobe}, 1},
+		{"comment", withSegments(plain, comment), nil, 1},
+		{"fill bytes", withSegments(plain, []byte{0xFF, 0xFF}, comment), nil, 1},
+		{"trailing image", append(withSegments(plain, xmp), withSegments(plain, exif(binary.BigEndian, 1))...), nil, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Strip("image/jpeg", tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(got, []byte("GPS!")) {
+				t.Error("Strip() kept metadata")
+			}
+
+			for _, k := range tt.keep {
+				if !bytes.Contains(got, k) {
+					t.Errorf("Strip() dropped % x", k[:4])
+				}
+			}
+
+			if o := Orientation(got); o != tt.wantOrientation {
+				t.Errorf("Orientation() = %d, want %d", o, tt.wantOrientation)
+			}
+
+			if !bytes.HasSuffix(got, []byte{0xFF, markerEOI}) {
+				t.Error("Strip() does not end with EOI")
+			}
+
+			// The entropy-coded data is copied as is
+			if !bytes.Contains(got, plain[len(plain)-64:]) {
+				t.Error("Strip() changed the scan")
+			}
+
+			img, err := jpeg.Decode(bytes.NewReader(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if b := img.Bounds(); b.Dx() != 4 || b.Dy() != 2 {
+				t.Errorf("stripped image is %dx%d, want 4x2", b.Dx(), b.Dy())
+			}
+		})
+	}
+}
+
+func TestStripProgressiveJPEG(t *testing.T) {
+	// Two scans, each followed by entropy-coded data with stuffed bytes and
+	// a restart marker
+	sof := segment(0xC2, []byte{8, 0, 1, 0, 1, 1, 1, 0x11, 0})
+	scan := segment(markerSOS, []byte{1, 1, 0, 0, 0, 0})
+	data := []byte{0xFF, markerSOI}
+	data = append(data, sof...)
+	data = append(data, scan...)
+	data = append(data, 0x12, 0xFF, 0x00, 0x34, 0xFF, markerRST0, 0x56)
+	data = append(data, segment(markerCOM, []byte("GPS!"))...)
+	data = append(data, scan...)
+	data = append(data, 0x78, 0xFF, 0x00)
+	data = append(data, 0xFF, markerEOI)
+
+	want := []byte{0xFF, markerSOI}
+	want = append(want, sof...)
+	want = append(want, scan...)
+	want = append(want, 0x12, 0xFF, 0x00, 0x34, 0xFF, markerRST0, 0x56)
+	want = append(want, scan...)
+	want = append(want, 0x78, 0xFF, 0x00)
+	want = append(want, 0xFF, markerEOI)
+
+	got, err := Strip("image/jpeg", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("Strip() = % x\nwant % x", got, want)
+	}
+}
+
+func TestStripMalformed(t *testing.T) {
+	plain := encodeJPEG(t, 4, 2)
+
+	pngData := new(bytes.Buffer)
+	if err := png.Encode(pngData, labeled(2, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+	}{
+		{"jpeg empty", "image/jpeg", nil},
+		{"jpeg signature", "image/jpeg", pngData.Bytes()},
+		{"jpeg truncated segment", "image/jpeg", withSegments(plain, exif(binary.BigEndian, 6))[:20]},
+		{"jpeg without EOI", "image/jpeg", plain[:len(plain)-2]},
+		{"jpeg garbage", "image/jpeg", []byte{0xFF, markerSOI, 0x00, 0x01, 0x02}},
+		{"png signature", "image/png", plain},
+		{"png truncated", "image/png", pngData.Bytes()[:pngData.Len()-6]},
+		{"png huge chunk", "image/png", append(append([]byte{}, pngSignature...), 0xFF, 0xFF, 0xFF, 0xF0, 'I', 'D', 'A', 'T', 0, 0, 0, 0)},
+		{"gif signature", "image/gif", plain},
+		{"gif truncated", "image/gif", encodeGIF(t)[:30]},
+		{"gif without trailer", "image/gif", bytes.TrimSuffix(encodeGIF(t), []byte{gifTrailer})},
+	}
+
+	for _, tt := range tests {
+		if _, err := Strip(tt.contentType, tt.data); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: Strip() error = %v, want ErrMalformed", tt.name, err)
+		}
+	}
+}
+
+func TestStripOther(t *testing.T) {
+	data := []byte("%PDF-1.7 GPS!")
+
+	got, err := Strip("application/pdf", data)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Strip() = %q, %v; want the data unchanged", got, err)
+	}
+
+	if Strippable("application/pdf") {
+		t.Error("Strippable(application/pdf) = true")
+	}
+}
+
+// chunk returns a PNG chunk.
+func chunk(typ string, data []byte) []byte {
+	c := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(c, uint32(len(data)))
+	copy(c[4:], typ)
+	c = append(c, data...)
+
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+func TestStripPNG(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, labeled(3, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := buf.Bytes()
+
+	// After the signature and IHDR
+	at := len(pngSignature) + 25
+
+	with := func(chunks ...[]byte) []byte {
+		out := append([]byte{}, plain[:at]...)
+		for _, c := range chunks {
+			out = append(out, c...)
+		}
+
+		return append(out, plain[at:]...)
+	}
+
+	gamma := chunk("gAMA", []byte{0, 0, 0xB1, 0x8F})
+
+	tests := []struct {
+		name string
+		data []byte
+		keep [][]byte
+	}{
+		{"plain", plain, nil},
+		{"text", with(chunk("tEXt", []byte("Comment\x00GPS!"))), nil},
+		{"compressed text", with(chunk("zTXt", []byte("Comment\x00\x00GPS!"))), nil},
+		{"international text", with(chunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00GPS!"))), nil},
+		{"exif", with(chunk("eXIf", append([]byte("MM\x00\x2A"), "GPS!"...))), nil},
+		{"time", with(chunk("tIME", []byte("GPS!\x01\x01\x01"))), nil},
+		{"gamma", with(gamma, chunk("tEXt", []byte("a\x00GPS!"))), [][]byte{gamma}},
+		{"trailing data", append(with(), "GPS!"...), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Strip("image/png", tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(got, []byte("GPS!")) {
+				t.Error("Strip() kept metadata")
+			}
+
+			for _, k := range tt.keep {
+				if !bytes.Contains(got, k) {
+					t.Errorf("Strip() dropped %s", k[4:8])
+				}
+			}
+
+			img, err := png.Decode(bytes.NewReader(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !equalRows(labels(toRGBA(img)), labels(labeled(3, 2))) {
+				t.Error("Strip() changed the pixels")
+			}
+		})
+	}
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+
+	rgba := image.NewRGBA(img.Bounds())
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			rgba.Set(x, y, img.At(x, y))
+		}
+	}
+
+	return rgba
+}
+
+// encodeGIF returns a looping two-frame GIF, which carries a NETSCAPE2.0
+// application extension.
+func encodeGIF(t *testing.T) []byte {
+	t.Helper()
+
+	frame := func(c color.Color) *image.Paletted {
+		img := image.NewPaletted(image.Rect(0, 0, 2, 2), palette.Plan9)
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 2; x++ {
+				img.Set(x, y, c)
+			}
+		}
+
+		return img
+	}
+
+	buf := new(bytes.Buffer)
+
+	err := gif.EncodeAll(buf, &gif.GIF{
+		Image: []*image.Paletted{frame(color.White), frame(color.Black)},
+		Delay: []int{10, 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// application returns a GIF application extension.
+func application(identifier string, data []byte) []byte {
+	ext := append([]byte{gifExtension, gifApplication, 11}, identifier...)
+	ext = append(ext, byte(len(data)))
+	ext = append(ext, data...)
+
+	return append(ext, 0)
+}
+
+func TestStripGIF(t *testing.T) {
+	plain := encodeGIF(t)
+
+	// Extensions go right before the trailer
+	with := func(blocks ...[]byte) []byte {
+		out := append([]byte{}, plain[:len(plain)-1]...)
+		for _, b := range blocks {
+			out = append(out, b...)
+		}
+
+		return append(out, gifTrailer)
+	}
+
+	comment := []byte{gifExtension, gifComment, 4, 'G', 'P', 'S', '!', 0}
+	xmp := application("XMP DataXMP", []byte("GPS!"))
+	icc := application("ICCRGBG1012", []byte("profile"))
+
+	tests := []struct {
+		name string
+		data []byte
+		keep [][]byte
+	}{
+		{"plain", plain, [][]byte{[]byte("NETSCAPE2.0")}},
+		{"comment", with(comment), nil},
+		{"xmp", with(xmp), nil},
+		{"icc", with(icc, xmp), [][]byte{icc}},
+		{"trailing data", append(with(), "GPS!"...), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Strip("image/gif", tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(got, []byte("GPS!")) {
+				t.Error("Strip() kept metadata")
+			}
+
+			for _, k := range tt.keep {
+				if !bytes.Contains(got, k) {
+					t.Errorf("Strip() dropped %q", k)
+				}
+			}
+
+			g, err := gif.DecodeAll(bytes.NewReader(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(g.Image) != 2 || g.LoopCount != 0 {
+				t.Errorf("stripped GIF has %d frames, loop count %d", len(g.Image), g.LoopCount)
+			}
+		})
+	}
+}
@@ -45,6 +45,12 @@ const (
 	// Cache
 	CacheControlNoStore string = "no-store"
 
+	// Bodies of routes other than UploadPath, which may send up to
+	// FiberConfig.BodyLimit
+	BodyLimit int = fiber.DefaultBodyLimit
+
+	UploadPath string = "/api/v1/file"
+
 	// Prefer
 	PreferTotalOnly string = "total-only"
 
@@ -58,6 +64,137 @@ const (
 
 	// JSON
 	VerificationJSONFilename string = "./json/verification.json"
+
+	// Time after sending during which a message may be edited
+	MessageEditWindow time.Duration = 15 * time.Minute
+
+	// Attachments a message may be sent with
+	MessageAttachmentLimit int = 10
+
+	// Uploaded files of the local storage driver, kept apart from ./tmp and
+	// its logs
+	FileStorageRoot string = "./storage"
+
+	// Bytes per uploaded file
+	FileMaxSize int64 = 10 * 1024 * 1024
+
+	// Bytes the files of one user and their previews may take in total
+	FileUserQuota int64 = 1024 * 1024 * 1024
+
+	// Quota reserved for an upload is given back after this long if the
+	// server stops while storing it
+	FileReservationTimeout time.Duration = 5 * time.Minute
+
+	// Uploads not sent with a message within this time are deleted
+	AttachmentUnsentTTL time.Duration = 24 * time.Hour
+
+	AttachmentCleanupInterval time.Duration = 10 * time.Minute
+
+	// Attachments and stored objects deleted per cleanup run
+	AttachmentCleanupBatch int = 500
+
+	// Lifetime of download URLs signed by the storage driver
+	FilePresignExpiration time.Duration = 5 * time.Minute
+
+	// Served by hfilesystem.Static
+	StaticRoot string = "./public"
+
+	// Image previews, made in the background after an upload
+	PreviewQueueSize int = 256
+
+	// Pending previews missed by the queue are picked up this often
+	PreviewSweepInterval time.Duration = time.Minute
+
+	// Previews still processing after this long, e.g. across a restart, are
+	// made again
+	PreviewStaleAfter time.Duration = 10 * time.Minute
+
+	// Both fit in ShutdownTimeout, so that a preview stopped by a shutdown is
+	// released before the database closes
+	PreviewTimeout time.Duration = 20 * time.Second
+
+	PreviewReleaseTimeout time.Duration = 5 * time.Second
+
+	// Images are decoded to 4 bytes per pixel
+	PreviewMaxPixels int = 40 * 1000 * 1000
+
+	// WebSocket
+	WebSocketSendBufferSize int = 256
+
+	WebSocketWriteWait time.Duration = 10 * time.Second
+
+	// Frames kept for a client while missed messages are replayed
+	WebSocketHeldLimit int = 1024
+
+	// Maximum number of missed messages replayed on reconnect
+	WebSocketReplayLimit int = 500
+
+	// Time allowed to read the next pong from the peer
+	WebSocketPongWait time.Duration = 60 * time.Second
+
+	// Must be less than WebSocketPongWait
+	WebSocketPingInterval time.Duration = 50 * time.Second
+
+	// Flood control: sustained frames per second and burst of a single
+	// connection, and of a user across connections
+	WebSocketRate float64 = 5
+
+	WebSocketBurst int = 20
+
+	WebSocketUserRate float64 = 10
+
+	WebSocketUserBurst int = 40
+
+	// Largest frame, in bytes, that is handled. Frames above four times
+	// this size close the connection.
+	WebSocketMaxFrameSize int64 = 16 * 1024
+
+	// A connection is muted for WebSocketMuteDuration after
+	// WebSocketMaxViolations violations within WebSocketViolationWindow
+	WebSocketMaxViolations int = 5
+
+	WebSocketViolationWindow time.Duration = 10 * time.Second
+
+	WebSocketMuteDuration time.Duration = 30 * time.Second
+
+	// Rooms a multiplexed socket may subscribe to
+	WebSocketSubscriptionLimit int = 500
+
+	// Time allowed without any event from the client
+	WebSocketIdleTimeout time.Duration = 10 * time.Minute
+
+	// Graceful shutdown deadline for draining sockets and in-flight requests
+	ShutdownTimeout time.Duration = 30 * time.Second
+
+	// Delay clients are told to wait before reconnecting after a shutdown
+	ShutdownReconnectDelay time.Duration = 5 * time.Second
+
+	// Server-Sent Events routes, skipped by the cache and ETag middlewares
+	StreamPathPrefix string = "/api/v1/stream/"
+
+	// LISTEN/NOTIFY channels of the postgres hub broker
+	HubBrokerChannel string = "chatbox_hub"
+
+	NotificationBrokerChannel string = "chatbox_notifications"
+
+	PresenceBrokerChannel string = "chatbox_presence"
+
+	// Typing indicator
+	TypingExpiration time.Duration = 5 * time.Second
+
+	TypingThrottle time.Duration = 2 * time.Second
+
+	// Presence
+	PresenceIdleTimeout time.Duration = 2 * time.Minute
+
+	PresenceSweepInterval time.Duration = 15 * time.Second
+
+	// Contacts told of presence changes are looked up again after this long
+	PresenceContactsTTL time.Duration = time.Minute
+
+	// Users of another node count as offline once the node has not sent its
+	// heartbeat, every PresenceSweepInterval, for this long
+	PresenceNodeTimeout time.Duration = 45 * time.Second
 )
 
 var (
@@ -69,7 +206,7 @@ var (
 		Immutable:     false,
 		UnescapePath:  true, // false,
 		// ETag: false,
-		BodyLimit:                    fiber.DefaultBodyLimit,
+		BodyLimit:                    int(FileMaxSize) + 1024*1024, // fiber.DefaultBodyLimit, held to BodyLimit outside of uploads
 		Concurrency:                  fiber.DefaultConcurrency,
 		Views:                        nil,
 		ViewsLayout:                  "",
@@ -104,7 +241,14 @@ var (
 	}
 
 	CacheConfig cache.Config = cache.Config{
-		Next:         nil,
+		// Responses are keyed by path alone, so responses to a user's
+		// credentials would be served to the next caller of the path. Event
+		// streams never end and cannot be stored either
+		Next: func(c *fiber.Ctx) bool {
+			return strings.HasPrefix(c.Path(), StreamPathPrefix) ||
+				c.Get(fiber.HeaderAuthorization) != "" ||
+				c.Query("token") != ""
+		},
 		Expiration:   1 * time.Minute,
 		CacheHeader:  "X-Cache",
 		CacheControl: true, // false,
@@ -176,7 +320,11 @@ var (
 
 	ETagConfig etag.Config = etag.Config{
 		Weak: false,
-		Next: nil,
+		// The tag is a hash of the whole body, which event streams never
+		// finish
+		Next: func(c *fiber.Ctx) bool {
+			return strings.HasPrefix(c.Path(), StreamPathPrefix)
+		},
 	}
 
 	ExpvarConfig expvar.Config = expvar.Config{
@@ -199,6 +347,39 @@ var (
 		LimiterMiddleware: limiter.FixedWindow{},
 	}
 
+	// Content types of uploads, or type/* for every subtype; deny wins over
+	// allow. Types are sniffed from the bytes, not taken from the client.
+	// Bytes that are not identified sniff as application/octet-stream, which
+	// is therefore not allowed: it would let any executable through.
+	FileAllowTypes []string = []string{
+		"image/*",
+		"audio/*",
+		"video/*",
+		"text/plain",
+		"application/pdf",
+		"application/zip",
+		"application/x-gzip",
+		"application/ogg",
+	}
+
+	// Types a browser could render as an active document
+	FileDenyTypes []string = []string{
+		"text/html",
+		"text/xml",
+		"image/svg+xml",
+	}
+
+	// Preview variants served with ?size=, by name and longest side, largest
+	// first as each is made from the previous one
+	ThumbnailSizes = []struct {
+		Name string
+		Max  int
+	}{
+		{Name: "large", Max: 1080},
+		{Name: "medium", Max: 480},
+		{Name: "small", Max: 160},
+	}
+
 	LoggerConfig logger.Config = logger.Config{
 		Next:         nil,
 		Format:       "${time} ${pid} ${locals:requestid} ${status} ${latency} ${ip}:${port} ${ips} ${method} ${protocol} ${host} ${path} ${queryParams} ${url} ${route} ${error} ${referer} ${ua}\n", // "[${time}] ${status} - ${latency} ${method} ${path}\n",
@@ -0,0 +1,134 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"chatbox/pkg/storage"
+)
+
+var errSize = errors.New("storage: size does not match the content")
+
+// Storage keeps objects as files under a root directory, fanned out by the
+// first two characters of their key. Content types are not kept.
+type Storage struct {
+	root string
+}
+
+func New(root string) *Storage {
+	return &Storage{root: root}
+}
+
+func (s *Storage) path(key string) (string, error) {
+	if !storage.ValidKey(key) {
+		return "", storage.ErrInvalidKey
+	}
+
+	return filepath.Join(s.root, key[:2], key), nil
+}
+
+func (s *Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r, size+1))
+	if err == nil && n != size {
+		err = errSize
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(path)
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *Storage) Get(ctx context.Context, key string) (io.ReadCloser, *storage.Object, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, storage.ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, object(key, info), nil
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return storage.ErrNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *Storage) Stat(ctx context.Context, key string) (*storage.Object, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return object(key, info), nil
+}
+
+// Presign is not supported; files are downloaded through the API.
+func (s *Storage) Presign(ctx context.Context, key, name string, expires time.Duration) (string, error) {
+	return "", storage.ErrNotSupported
+}
+
+func object(key string, info os.FileInfo) *storage.Object {
+	return &storage.Object{
+		Key:     key,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+}
@@ -0,0 +1,385 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"chatbox/pkg/storage"
+)
+
+const (
+	algorithm = "AWS4-HMAC-SHA256"
+
+	service = "s3"
+
+	// Payloads are streamed, so their hash is not part of the signature
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// Longest expiry SigV4 allows for a presigned URL
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// Limits of a request to the service. Bodies are streamed, so only
+// connecting and waiting for the response headers are bounded; the caller's
+// context bounds the rest.
+const (
+	dialTimeout = 10 * time.Second
+
+	tlsHandshakeTimeout = 10 * time.Second
+
+	responseHeaderTimeout = 30 * time.Second
+
+	idleConnTimeout = 90 * time.Second
+)
+
+// Config addresses a bucket of an S3-compatible service. Objects are
+// addressed path-style, as Endpoint/Bucket/key, which AWS and MinIO-style
+// services both accept.
+type Config struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// Storage keeps objects in an S3-compatible bucket, signing requests with
+// AWS Signature Version 4.
+type Storage struct {
+	config   Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+func New(config Config) (*Storage, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", config.Endpoint)
+	}
+
+	if config.Bucket == "" || config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("s3: bucket and credentials are required")
+	}
+
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	return &Storage{
+		config:   config,
+		endpoint: endpoint,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   tlsHandshakeTimeout,
+				ResponseHeaderTimeout: responseHeaderTimeout,
+				ExpectContinueTimeout: time.Second,
+				IdleConnTimeout:       idleConnTimeout,
+				MaxIdleConnsPerHost:   16,
+			},
+		},
+		now: time.Now,
+	}, nil
+}
+
+// url returns the path-style URL of key.
+func (s *Storage) url(key string) (*url.URL, error) {
+	if !storage.ValidKey(key) {
+		return nil, storage.ErrInvalidKey
+	}
+
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.config.Bucket + "/" + key
+
+	return &u, nil
+}
+
+// do sends a signed request for key and fails on any status but 2xx.
+func (s *Storage) do(ctx context.Context, method, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	u, err := s.url(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	s.sign(req, unsignedPayload, s.now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, storage.ErrNotFound
+	}
+
+	detail, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+
+	return nil, fmt.Errorf("s3: %s %s: %s: %s", method, key, res.Status, detail)
+}
+
+func (s *Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	res, err := s.do(ctx, http.MethodPut, key, r, size, contentType)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (s *Storage) Get(ctx context.Context, key string) (io.ReadCloser, *storage.Object, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return res.Body, object(key, res), nil
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	// Deleting a missing object succeeds on S3, so it is checked first
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+
+	res, err := s.do(ctx, http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (s *Storage) Stat(ctx context.Context, key string) (*storage.Object, error) {
+	res, err := s.do(ctx, http.MethodHead, key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	return object(key, res), nil
+}
+
+// Presign returns a SigV4 query-signed GET URL of key. A name sets the
+// Content-Disposition of the response.
+func (s *Storage) Presign(ctx context.Context, key, name string, expires time.Duration) (string, error) {
+	u, err := s.url(key)
+	if err != nil {
+		return "", err
+	}
+
+	if expires <= 0 || expires > maxPresignExpiry {
+		return "", fmt.Errorf("s3: presign expiry must be within %s", maxPresignExpiry)
+	}
+
+	return s.presign(u, name, expires), nil
+}
+
+// presign signs the GET request of u in its query.
+func (s *Storage) presign(u *url.URL, name string, expires time.Duration) string {
+	now := s.now().UTC()
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", algorithm)
+	query.Set("X-Amz-Credential", s.config.AccessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	if name != "" {
+		query.Set("response-content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+
+	u.RawQuery = canonicalQuery(query)
+
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		canonicalPath(u),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(canonical, now)
+
+	return u.String()
+}
+
+// sign adds the Authorization header of req. The host, the content type and
+// every x-amz header are signed.
+func (s *Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+
+	headers := map[string]string{"host": req.URL.Host}
+
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "range" {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, s.config.AccessKeyID, s.scope(now), signedHeaders, s.signature(canonical, now),
+	))
+}
+
+func (s *Storage) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.config.Region + "/" + service + "/aws4_request"
+}
+
+// signature signs a canonical request with the key derived for its day.
+func (s *Storage) signature(canonical string, now time.Time) string {
+	hash := sha256.Sum256([]byte(canonical))
+
+	stringToSign := strings.Join([]string{
+		algorithm,
+		now.Format("20060102T150405Z"),
+		s.scope(now),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// canonicalPath encodes each segment of the path of u once.
+func canonicalPath(u *url.URL) string {
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		segments[i] = encode(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery encodes query sorted by name, then value.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return encode(names[i]) < encode(names[j]) })
+
+	pairs := make([]string, 0, len(query))
+
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+
+		for _, value := range values {
+			pairs = append(pairs, encode(name)+"="+encode(value))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// encode percent-encodes every byte but the unreserved characters of
+// RFC 3986, as SigV4 requires.
+func encode(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func object(key string, res *http.Response) *storage.Object {
+	obj := &storage.Object{
+		Key:         key,
+		Size:        res.ContentLength,
+		ContentType: res.Header.Get("Content-Type"),
+	}
+
+	if modTime, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		obj.ModTime = modTime
+	}
+
+	return obj
+}
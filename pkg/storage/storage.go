@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"chatbox/pkg/util"
+)
+
+var (
+	ErrInvalidKey = errors.New("storage: invalid object key")
+
+	ErrNotFound = errors.New("storage: object not found")
+
+	ErrNotSupported = errors.New("storage: operation not supported by the driver")
+
+	ErrTypeNotAllowed = errors.New("storage: content type not allowed")
+)
+
+// Files is the storage of uploaded files, selected by STORAGE_DRIVER.
+var Files Storage
+
+// Object describes a stored object. Drivers that keep no content type leave
+// ContentType empty.
+type Object struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// Storage keeps objects by key.
+type Storage interface {
+	// Put stores the size bytes of r as key. Reading more or fewer bytes
+	// than size fails.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Get opens key for reading. The caller closes the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, *Object, error)
+
+	Delete(ctx context.Context, key string) error
+
+	Stat(ctx context.Context, key string) (*Object, error)
+
+	// Presign returns a URL that downloads key without credentials until
+	// expires passes, saved as name when it is set. Drivers that cannot
+	// sign URLs return ErrNotSupported.
+	Presign(ctx context.Context, key, name string, expires time.Duration) (string, error)
+}
+
+// Object keys are server-generated, so client filenames never reach a path
+var keyRegExp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// NewKey returns a random object key.
+func NewKey() (string, error) {
+	return util.RandomHexCode(16)
+}
+
+// ValidKey reports whether key has the form NewKey returns.
+func ValidKey(key string) bool {
+	return keyRegExp.MatchString(key)
+}
+
+// CleanName returns the base of a client filename without control
+// characters, for use in Content-Disposition only.
+func CleanName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+
+	if len(name) > 255 {
+		name = name[:255]
+	}
+
+	if name == "." || name == ".." || name == "/" || name == "" {
+		name = "file"
+	}
+
+	return strings.ToValidUTF8(name, "")
+}
+
+// Policy limits what may be stored.
+type Policy struct {
+	// Bytes per file
+	MaxSize int64
+
+	// MIME types, or type/* for every subtype. Deny wins over Allow
+	Allow []string
+	Deny  []string
+}
+
+// Permits reports whether files of contentType may be stored.
+func (p Policy) Permits(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return matches(p.Allow, mediaType) && !matches(p.Deny, mediaType)
+}
+
+func matches(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if pattern == mediaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sniff detects the content type of r from its first bytes, whatever the
+// client claims. The returned reader yields all of r.
+func Sniff(r io.Reader) (string, io.Reader, error) {
+	head := make([]byte, 512)
+
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+
+	head = head[:n]
+
+	return http.DetectContentType(head), io.MultiReader(bytes.NewReader(head), r), nil
+}
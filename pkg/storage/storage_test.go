@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestValidKey(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key, true},
+		{"0123456789abcdef0123456789abcdef", true},
+		{"0123456789ABCDEF0123456789ABCDEF", false},
+		{"0123456789abcdef", false},
+		{"../../etc/passwd", false},
+		{"0123456789abcdef0123456789abcde/", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidKey(tt.key); got != tt.want {
+			t.Errorf("ValidKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Users\alice\report.pdf`, "report.pdf"},
+		{"dir/", "dir"},
+		{"a\r\nContent-Type: text.txt", "aContent-Type: text.txt"},
+		{"tab\there.txt", "tabhere.txt"},
+		{"résumé.pdf", "résumé.pdf"},
+		{"bad\xffutf8.txt", "bad\ufffdutf8.txt"},
+		{"", "file"},
+		{".", "file"},
+		{"..", "file"},
+		{"a/..", "file"},
+		{"/", "file"},
+		{"\x00", "file"},
+		{strings.Repeat("a", 300), strings.Repeat("a", 255)},
+		// Cut in the middle of a two-byte rune
+		{strings.Repeat("a", 254) + "é", strings.Repeat("a", 254)},
+	}
+
+	for _, tt := range tests {
+		if got := CleanName(tt.name); got != tt.want {
+			t.Errorf("CleanName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyPermits(t *testing.T) {
+	policy := Policy{
+		Allow: []string{"image/*", "application/pdf", "text/plain"},
+		Deny:  []string{"image/svg+xml"},
+	}
+
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"image/png", true},
+		{"image/jpeg", true},
+		{"IMAGE/PNG", true},
+		{"application/pdf", true},
+		{"text/plain; charset=utf-8", true},
+		{"image/svg+xml", false},
+		{"text/html", false},
+		{"application/octet-stream", false},
+		{"imagepng", false},
+		{"image", false},
+		{"images/png", false},
+		{"", false},
+		{"text/plain; charset", false},
+	}
+
+	for _, tt := range tests {
+		if got := policy.Permits(tt.contentType); got != tt.want {
+			t.Errorf("Permits(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyPermitsNothing(t *testing.T) {
+	if (Policy{}).Permits("text/plain") {
+		t.Error("an empty Allow list permits text/plain")
+	}
+}
+
+func TestSniff(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	html := []byte("<!DOCTYPE html><script>alert(1)</script>")
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"png", png, "image/png"},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), "image/gif"},
+		{"pdf", []byte("%PDF-1.7\n"), "application/pdf"},
+		{"html", html, "text/html; charset=utf-8"},
+		{"text", []byte("hello"), "text/plain; charset=utf-8"},
+		{"binary", []byte{0x00, 0x01, 0x02, 0x03}, "application/octet-stream"},
+		{"empty", nil, "text/plain; charset=utf-8"},
+		{"large", append(append([]byte{}, png...), bytes.Repeat([]byte{0}, 4096)...), "image/png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, r, err := Sniff(bytes.NewReader(tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if contentType != tt.want {
+				t.Errorf("Sniff() = %q, want %q", contentType, tt.want)
+			}
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, tt.content) {
+				t.Errorf("reader yields %d bytes, want %d", len(got), len(tt.content))
+			}
+		})
+	}
+}
+
+func TestSniffShortReads(t *testing.T) {
+	content := []byte("%PDF-1.7\n" + strings.Repeat("x", 1000))
+
+	contentType, r, err := Sniff(iotest.OneByteReader(bytes.NewReader(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "application/pdf" {
+		t.Errorf("Sniff() = %q, want application/pdf", contentType)
+	}
+
+	got, _ := io.ReadAll(r)
+	if !bytes.Equal(got, content) {
+		t.Errorf("reader yields %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestSniffError(t *testing.T) {
+	failure := errors.New("connection reset")
+
+	if _, _, err := Sniff(iotest.ErrReader(failure)); !errors.Is(err, failure) {
+		t.Errorf("Sniff() error = %v, want %v", err, failure)
+	}
+}
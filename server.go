@@ -5,17 +5,38 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/joho/godotenv"
 
+	cws "chatbox/app/controller/ws"
+	sattachment "chatbox/app/service/attachment"
+
 	"chatbox/pkg/channel"
+	"chatbox/pkg/channel/broker"
+	bmemory "chatbox/pkg/channel/broker/memory"
+	bpostgres "chatbox/pkg/channel/broker/postgres"
+	"chatbox/pkg/channel/event"
 	chub "chatbox/pkg/channel/hub"
+	"chatbox/pkg/channel/presence"
+	"chatbox/pkg/channel/ratelimit"
+	"chatbox/pkg/channel/typing"
 	"chatbox/pkg/database"
 	"chatbox/pkg/database/postgres"
 	"chatbox/pkg/email"
 	"chatbox/pkg/email/gomail"
+	hfile "chatbox/pkg/handler/file"
+	"chatbox/pkg/media"
 	"chatbox/pkg/settings"
+	"chatbox/pkg/storage"
+	slocal "chatbox/pkg/storage/local"
+	ss3 "chatbox/pkg/storage/s3"
 )
 
 func init() {
@@ -43,6 +64,75 @@ func setupLogFile(filename string) (*os.File, error) {
 	return file, nil
 }
 
+// newBroker returns the hub broker selected by HUB_BROKER, publishing on
+// the given postgres channel when LISTEN/NOTIFY is used.
+func newBroker(pg *postgres.PostgresDB, brokerChannel string) (broker.Broker, error) {
+	switch os.Getenv("HUB_BROKER") {
+	case "postgres":
+		return bpostgres.New(pg, brokerChannel)
+	default:
+		return bmemory.New(), nil
+	}
+}
+
+// newStorage returns the file storage selected by STORAGE_DRIVER.
+func newStorage() (storage.Storage, error) {
+	switch os.Getenv("STORAGE_DRIVER") {
+	case "s3":
+		return ss3.New(ss3.Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		})
+	default:
+		return slocal.New(settings.FileStorageRoot), nil
+	}
+}
+
+// shutdown closes the hub connections with a reconnect hint, then waits for
+// in-flight requests, socket handlers and background workers, all within
+// settings.ShutdownTimeout. The database is closed by main once it returns.
+func shutdown(app *fiber.App, stopWorkers context.CancelFunc, workers *sync.WaitGroup) {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.ShutdownTimeout)
+	defer cancel()
+
+	// Clients are told to reconnect, to another node, after the delay
+	hint := fmt.Sprintf("reconnect_after=%d", settings.ShutdownReconnectDelay.Milliseconds())
+
+	for _, hub := range []*chub.Hub{channel.ChatHub, channel.NotificationHub} {
+		if err := hub.Shutdown(ctx, websocket.CloseGoingAway, hint); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if err := app.ShutdownWithContext(ctx); err != nil {
+		log.Print(err)
+	}
+
+	// Closed sockets stop reading, but a frame already read may still be
+	// handled
+	if err := cws.Wait(ctx); err != nil {
+		log.Print(err)
+	}
+
+	stopWorkers()
+
+	stopped := make(chan struct{})
+
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Print(ctx.Err())
+	}
+}
+
 func main() {
 	// Set up error log file
 	errorLogFile, err := setupLogFile(settings.ErrorLogFilename)
@@ -116,14 +206,127 @@ func main() {
 	email.GomailV2Dialer = dialer
 	email.GomailV2From, email.GomailV2Name = os.Getenv("GOMAIL_FROM"), os.Getenv("GOMAIL_NAME")
 
+	files, err := newStorage()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storage.Files = files
+
+	hfile.Policy = storage.Policy{
+		MaxSize: settings.FileMaxSize,
+		Allow:   settings.FileAllowTypes,
+		Deny:    settings.FileDenyTypes,
+	}
+
+	for _, size := range settings.ThumbnailSizes {
+		sattachment.ThumbnailSizes = append(sattachment.ThumbnailSizes, media.Size(size))
+	}
+
+	cws.Limit(ratelimit.Config{
+		Rate:            settings.WebSocketRate,
+		Burst:           settings.WebSocketBurst,
+		UserRate:        settings.WebSocketUserRate,
+		UserBurst:       settings.WebSocketUserBurst,
+		MaxFrameSize:    settings.WebSocketMaxFrameSize,
+		MaxViolations:   settings.WebSocketMaxViolations,
+		ViolationWindow: settings.WebSocketViolationWindow,
+		MuteDuration:    settings.WebSocketMuteDuration,
+	})
+
 	channel.ChatHub = chub.New()
 
+	channel.NotificationHub = chub.New()
+
+	// Bridge the hubs so broadcasts reach sockets on every node
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		nodeID = utils.UUIDv4()
+	}
+
+	for hub, brokerChannel := range map[*chub.Hub]string{
+		channel.ChatHub:         settings.HubBrokerChannel,
+		channel.NotificationHub: settings.NotificationBrokerChannel,
+	} {
+		hubBroker, err := newBroker(pg, brokerChannel)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer hubBroker.Close()
+
+		if err := hub.Bridge(hubBroker, nodeID); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	channel.ChatPresence = presence.New(settings.PresenceIdleTimeout, cws.Presence)
+
+	// Users connected to other nodes count as online here too
+	presenceBroker, err := newBroker(pg, settings.PresenceBrokerChannel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer presenceBroker.Close()
+
+	if err := channel.ChatPresence.Bridge(presenceBroker, nodeID, settings.PresenceNodeTimeout); err != nil {
+		log.Fatal(err)
+	}
+
+	// Chat and notification sockets both count towards presence
+	for _, hub := range []*chub.Hub{channel.ChatHub, channel.NotificationHub} {
+		hub.Hooks(
+			func(client *chub.Client) { channel.ChatPresence.Connect(client.UserID(), client) },
+			func(client *chub.Client) { channel.ChatPresence.Disconnect(client.UserID(), client) },
+		)
+	}
+
+	channel.ChatTyping = typing.New(settings.TypingExpiration, func(room string, userID int64) {
+		cws.Typing(room, userID, event.TypeTypingStop)
+	})
+
 	go channel.ChatHub.Run()
+	go channel.NotificationHub.Run()
+	go channel.ChatPresence.Run(settings.PresenceSweepInterval)
+
+	// Workers that use the database are stopped before it is closed
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	var workers sync.WaitGroup
+
+	workers.Add(1)
+
+	go func() {
+		defer workers.Done()
+		sattachment.RunPreviews(workerCtx, settings.PreviewSweepInterval)
+	}()
+
+	workers.Add(1)
+
+	go func() {
+		defer workers.Done()
+		sattachment.RunCleanup(workerCtx, settings.AttachmentCleanupInterval)
+	}()
+
 	// Initialize and run the app
 	app := New()
 
-	if err := app.Listen(fmt.Sprintf("0.0.0.0:%s", port)); err != nil {
+	listen := make(chan error, 1)
+
+	go func() {
+		listen <- app.Listen(fmt.Sprintf("0.0.0.0:%s", port))
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-listen:
 		_ = app.Shutdown()
 		log.Fatal(err)
+	case <-quit:
+		shutdown(app, stopWorkers, &workers)
 	}
 }
@@ -0,0 +1,2 @@
+-- Last time a user was seen connected, kept across restarts for presence
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ;
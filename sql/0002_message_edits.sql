@@ -0,0 +1,11 @@
+-- Prior versions of edited messages, readable by channel admins
+CREATE TABLE IF NOT EXISTS message_edits (
+    id BIGSERIAL PRIMARY KEY,
+    receiver_class TEXT NOT NULL CHECK (receiver_class IN ('user', 'channel')),
+    message_id BIGINT NOT NULL,
+    message TEXT NOT NULL,
+    edited_by BIGINT NOT NULL REFERENCES users (id),
+    edited_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS message_edits_message_idx ON message_edits (receiver_class, message_id, id);
@@ -0,0 +1,4 @@
+-- Who removed a message: its sender, or a channel admin moderating it
+ALTER TABLE direct_messages ADD COLUMN IF NOT EXISTS deleted_by BIGINT REFERENCES users (id);
+
+ALTER TABLE channel_messages ADD COLUMN IF NOT EXISTS deleted_by BIGINT REFERENCES users (id);
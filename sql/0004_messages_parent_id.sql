@@ -0,0 +1,8 @@
+-- Thread replies point at the message that started the thread
+ALTER TABLE direct_messages ADD COLUMN IF NOT EXISTS parent_id BIGINT REFERENCES direct_messages (id);
+
+ALTER TABLE channel_messages ADD COLUMN IF NOT EXISTS parent_id BIGINT REFERENCES channel_messages (id);
+
+CREATE INDEX IF NOT EXISTS direct_messages_parent_idx ON direct_messages (parent_id, id) WHERE parent_id IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS channel_messages_parent_idx ON channel_messages (parent_id, id) WHERE parent_id IS NOT NULL;
@@ -0,0 +1,9 @@
+-- Emoji reactions, one per user per emoji on a message
+CREATE TABLE IF NOT EXISTS message_reactions (
+    receiver_class TEXT NOT NULL CHECK (receiver_class IN ('user', 'channel')),
+    message_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (receiver_class, message_id, emoji, user_id)
+);
@@ -0,0 +1,14 @@
+-- Last message each user has read in each channel or direct conversation.
+-- For direct messages receiver_id is the other user.
+CREATE TABLE IF NOT EXISTS read_positions (
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    receiver_class TEXT NOT NULL CHECK (receiver_class IN ('user', 'channel')),
+    receiver_id BIGINT NOT NULL,
+    last_read_id BIGINT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, receiver_class, receiver_id)
+);
+
+CREATE INDEX IF NOT EXISTS channel_messages_channel_idx ON channel_messages (channel_id, id);
+
+CREATE INDEX IF NOT EXISTS direct_messages_pair_idx ON direct_messages (sender_id, receiver_id, id);
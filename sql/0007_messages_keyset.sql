@@ -0,0 +1,4 @@
+-- Keyset pagination of a conversation on (sent_at, id).
+CREATE INDEX IF NOT EXISTS channel_messages_keyset_idx ON channel_messages (channel_id, sent_at, id);
+
+CREATE INDEX IF NOT EXISTS direct_messages_keyset_idx ON direct_messages (sender_id, receiver_id, sent_at, id);
@@ -0,0 +1,13 @@
+-- Full-text search of messages. The simple configuration neither stems nor
+-- drops stop words, so it works the same for every language.
+ALTER TABLE direct_messages
+    ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', coalesce(message, ''))) STORED;
+
+ALTER TABLE channel_messages
+    ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', coalesce(message, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS direct_messages_search_idx ON direct_messages USING GIN (search_vector);
+
+CREATE INDEX IF NOT EXISTS channel_messages_search_idx ON channel_messages USING GIN (search_vector);
@@ -0,0 +1,16 @@
+-- Files uploaded to be sent with a message. receiver_class and message_id are
+-- set when the message is sent; until then only the owner may download it.
+CREATE TABLE IF NOT EXISTS attachments (
+    id BIGSERIAL PRIMARY KEY,
+    owner_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    object_key TEXT NOT NULL UNIQUE,
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    checksum TEXT NOT NULL,
+    receiver_class TEXT CHECK (receiver_class IN ('user', 'channel')),
+    message_id BIGINT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS attachments_message_idx ON attachments (receiver_class, message_id);
@@ -0,0 +1,22 @@
+-- Image metadata and thumbnails, made by a background worker after upload.
+-- preview_status is NULL for files that have no previews.
+ALTER TABLE attachments
+    ADD COLUMN IF NOT EXISTS width INT,
+    ADD COLUMN IF NOT EXISTS height INT,
+    ADD COLUMN IF NOT EXISTS dominant_color TEXT,
+    ADD COLUMN IF NOT EXISTS preview_status TEXT CHECK (preview_status IN ('pending', 'processing', 'ready', 'failed')),
+    ADD COLUMN IF NOT EXISTS preview_updated_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS attachments_preview_idx ON attachments (preview_status, preview_updated_at)
+    WHERE preview_status IN ('pending', 'processing');
+
+CREATE TABLE IF NOT EXISTS attachment_variants (
+    attachment_id BIGINT NOT NULL REFERENCES attachments (id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    object_key TEXT NOT NULL UNIQUE,
+    content_type TEXT NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    size BIGINT NOT NULL,
+    PRIMARY KEY (attachment_id, name)
+);
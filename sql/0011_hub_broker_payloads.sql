@@ -0,0 +1,9 @@
+-- Hub broker messages too large for a NOTIFY payload. Only the id is
+-- notified; every node reads the row, which is deleted after a few minutes.
+CREATE TABLE IF NOT EXISTS hub_broker_payloads (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS hub_broker_payloads_created_at_idx ON hub_broker_payloads (created_at);
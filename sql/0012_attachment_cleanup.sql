@@ -0,0 +1,29 @@
+-- Object keys of deleted attachments and previews, however the rows went
+-- away, including with their owner. The stored objects are deleted by the
+-- cleanup worker, which then removes the keys.
+CREATE TABLE IF NOT EXISTS deleted_objects (
+    object_key TEXT PRIMARY KEY,
+    deleted_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE OR REPLACE FUNCTION queue_deleted_object() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO deleted_objects (object_key) VALUES (OLD.object_key) ON CONFLICT DO NOTHING;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS attachments_deleted_object ON attachments;
+
+CREATE TRIGGER attachments_deleted_object
+    AFTER DELETE ON attachments
+    FOR EACH ROW EXECUTE FUNCTION queue_deleted_object();
+
+DROP TRIGGER IF EXISTS attachment_variants_deleted_object ON attachment_variants;
+
+CREATE TRIGGER attachment_variants_deleted_object
+    AFTER DELETE ON attachment_variants
+    FOR EACH ROW EXECUTE FUNCTION queue_deleted_object();
+
+-- Uploads never sent with a message expire
+CREATE INDEX IF NOT EXISTS attachments_unsent_idx ON attachments (created_at) WHERE message_id IS NULL;
@@ -0,0 +1,12 @@
+-- Quota held for uploads being stored, from before the object is written
+-- until it is recorded in attachments or the upload fails. Reservations left
+-- behind by a stopped server stop counting once expired and are deleted by
+-- the cleanup worker.
+CREATE TABLE IF NOT EXISTS attachment_reservations (
+    id BIGSERIAL PRIMARY KEY,
+    owner_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    size BIGINT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS attachment_reservations_owner_idx ON attachment_reservations (owner_id, expires_at);